@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// accessLog receives one record per finished session. Nil if disabled.
+var accessLog *log.Logger
+
+// Open the access log at path. "-" means stdout.
+func openAccessLog(path string) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	accessLog = log.New(w, "", 0)
+	return nil
+}
+
+// session describes a TCP relay or UDP NAT session for the access log.
+type session struct {
+	Proto    string    // "tcp" or "udp"
+	Start    time.Time // when the session was accepted
+	Client   net.Addr  // peer that initiated the session
+	User     string    // user the session is accounted to, if known
+	Target   string    // target as requested (domain or IP)
+	Resolved net.Addr  // address the target resolved to, if known
+	Up       int64     // bytes from client to target
+	Down     int64     // bytes from target to client
+
+	admit func() bool // see Admit
+}
+
+func newSession(proto string, client net.Addr) *session {
+	return &session{Proto: proto, Start: time.Now(), Client: client}
+}
+
+// Log writes the session record with the given close reason.
+func (s *session) Log(reason string) {
+	if accessLog == nil {
+		return
+	}
+	resolved := "-"
+	if s.Resolved != nil {
+		resolved = s.Resolved.String()
+	}
+	accessLog.Printf("%s %s dur=%.3f client=%s user=%s target=%s ip=%s up=%d down=%d reason=%q",
+		s.Start.UTC().Format(time.RFC3339), s.Proto, time.Since(s.Start).Seconds(), s.Client,
+		orDash(s.User), orDash(s.Target), resolved, atomic.LoadInt64(&s.Up), atomic.LoadInt64(&s.Down), reason)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// closeReason summarizes err as the reason a session ended.
+func closeReason(err error) string {
+	switch err {
+	case nil, io.EOF:
+		return "eof"
+	case errIdleTimeout:
+		return "idle"
+	case errMaxLifetime:
+		return "lifetime"
+	case errNATClosed:
+		return "closed"
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return "idle"
+	}
+	return fmt.Sprintf("error: %v", err)
+}
+
+// countedPacketConn counts bytes written to and read from a NAT socket into a session.
+type countedPacketConn struct {
+	net.PacketConn
+	s *session
+}
+
+func (c *countedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	atomic.AddInt64(&c.s.Up, int64(n))
+	return n, err
+}
+
+func (c *countedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	atomic.AddInt64(&c.s.Down, int64(n))
+	return n, addr, err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// socksAssociations holds the UDP associations of each SOCKS listen address,
+// shared by the TCP and UDP sides of the port.
+var socksAssociations = struct {
+	sync.Mutex
+	m map[string]*associations
+}{m: make(map[string]*associations)}
+
+// associationsOf returns the UDP associations of the SOCKS port on laddr.
+func associationsOf(laddr string) *associations {
+	socksAssociations.Lock()
+	defer socksAssociations.Unlock()
+	as, ok := socksAssociations.m[laddr]
+	if !ok {
+		as = &associations{
+			pending: make(map[*association]bool),
+			peers:   make(map[string]*association),
+		}
+		socksAssociations.m[laddr] = as
+	}
+	return as
+}
+
+// associations tracks the clients allowed to send datagrams to a SOCKS UDP
+// relay, each for as long as its UDP ASSOCIATE control connection lasts.
+type associations struct {
+	sync.Mutex
+	pending  map[*association]bool   // waiting for their first datagram
+	peers    map[string]*association // by client UDP address
+	teardown func(peer string)       // releases the NAT session of peer
+}
+
+// association is a single UDP ASSOCIATE request.
+type association struct {
+	ip   net.IP
+	peer string // client UDP address, empty until known
+}
+
+// Register admits datagrams from the client of control connection c, coming
+// from req as sent in its UDP ASSOCIATE request. Zero IP or port in req means
+// the client's IP and the port of its first datagram.
+func (as *associations) Register(c net.Conn, req socks.Addr) *association {
+	a := &association{}
+	var port string
+	if host, p, err := net.SplitHostPort(req.String()); err == nil {
+		a.ip, port = net.ParseIP(host), p
+	}
+	if a.ip == nil || a.ip.IsUnspecified() {
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			a.ip = addr.IP
+		}
+	}
+
+	as.Lock()
+	defer as.Unlock()
+	if port == "" || port == "0" {
+		as.pending[a] = true
+	} else {
+		a.peer = net.JoinHostPort(a.ip.String(), port)
+		as.peers[a.peer] = a
+	}
+	return a
+}
+
+// Allow reports whether a datagram from peer belongs to an association.
+func (as *associations) Allow(peer net.Addr) bool {
+	key := peer.String()
+	as.Lock()
+	defer as.Unlock()
+	if _, ok := as.peers[key]; ok {
+		return true
+	}
+	addr, ok := peer.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for a := range as.pending {
+		if a.ip.Equal(addr.IP) {
+			delete(as.pending, a)
+			a.peer = key
+			as.peers[key] = a
+			return true
+		}
+	}
+	return false
+}
+
+// Remove ends association a, tearing down the NAT session of its client.
+func (as *associations) Remove(a *association) {
+	as.Lock()
+	delete(as.pending, a)
+	owned := a.peer != "" && as.peers[a.peer] == a
+	if owned {
+		delete(as.peers, a.peer)
+	}
+	teardown := as.teardown
+	as.Unlock()
+
+	if owned && teardown != nil {
+		teardown(a.peer)
+	}
+}
+
+// SetTeardown sets the function releasing the NAT session of a client whose
+// association ends.
+func (as *associations) SetTeardown(f func(peer string)) {
+	as.Lock()
+	defer as.Unlock()
+	as.teardown = f
+}
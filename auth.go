@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Parse a comma-separated list of user:password pairs.
+func parseUserList(s string) (socks.StaticCredentials, error) {
+	creds := make(socks.StaticCredentials)
+	for _, up := range strings.Split(s, ",") {
+		i := strings.IndexByte(up, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid user:password pair %q", up)
+		}
+		creds[up[:i]] = up[i+1:]
+	}
+	return creds, nil
+}
+
+// htpasswd checks credentials against an Apache htpasswd-style file with
+// bcrypt, {SHA} or plain text passwords.
+type htpasswd struct {
+	sync.RWMutex
+	path  string
+	users map[string]string // hashed password by user name
+}
+
+func newHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path}
+	return h, h.Load()
+}
+
+// Load (re)reads the file.
+func (h *htpasswd) Load() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		i := strings.IndexByte(l, ':')
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: malformed entry", h.path, line)
+		}
+		hash := l[i+1:]
+		if strings.HasPrefix(hash, "$") && !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("%s:%d: unsupported password hash, use bcrypt (htpasswd -B)", h.path, line)
+		}
+		users[l[:i]] = hash
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.users = users
+	h.Unlock()
+	return nil
+}
+
+// Valid reports whether password matches the entry of user.
+func (h *htpasswd) Valid(user, password string) bool {
+	h.RLock()
+	hash, ok := h.users[user]
+	h.RUnlock()
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// bindFlag is set in the address type of the target address a client sends to
+// mark a SOCKS BIND request instead of a connect. The address then names the
+// peer expected to connect, as in the SOCKS request. The server replies on the
+// stream with the address it listens on, then with the address of the peer
+// once it has connected, and relays as usual.
+const bindFlag = 0x40
+
+var errBindNotAllowed = errors.New("BIND not allowed")
+
+// bindTimeout is how long the server waits for the peer of a BIND request.
+const bindTimeout = 2 * time.Minute
+
+// Make a BIND request for peer to send to the server.
+func bindRequest(peer socks.Addr) []byte {
+	b := append([]byte(nil), peer...)
+	b[0] |= bindFlag
+	return b
+}
+
+// Read the target address sent by a client, and the request flags (bindFlag,
+// replyFlag) set in its address type.
+func readTarget(r io.Reader) (socks.Addr, byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, err
+	}
+	flags := b[0] & (bindFlag | replyFlag)
+	b[0] &^= flags
+	tgt, err := socks.ReadAddr(io.MultiReader(bytes.NewReader(b), r))
+	return tgt, flags, err
+}
+
+// Relay the two replies of a BIND request from the server rc to the SOCKS client c.
+func bindReplies(c, rc net.Conn) error {
+	for i := 0; i < 2; i++ {
+		bnd, err := socks.ReadAddr(rc)
+		if err != nil {
+			socks.Reply(c, socks.ErrGeneralFailure, nil)
+			return err
+		}
+		if err := socks.Reply(c, nil, bnd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve a BIND request from client c: listen, report the address, and wait for
+// peer to connect. An unspecified peer IP or port accepts any.
+func bindRemote(c net.Conn, peer socks.Addr) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	if _, err := c.Write(socks.ParseAddr(l.Addr().String())); err != nil {
+		return nil, err
+	}
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(bindTimeout))
+	want, err := net.ResolveTCPAddr("tcp", peer.String())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rc, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		got := rc.RemoteAddr().(*net.TCPAddr)
+		if (want.IP.IsUnspecified() || want.IP.Equal(got.IP)) && (want.Port == 0 || want.Port == got.Port) {
+			if _, err := c.Write(socks.ParseAddr(got.String())); err != nil {
+				rc.Close()
+				return nil, err
+			}
+			return rc, nil
+		}
+		logf("BIND: unexpected peer %s, want %s", got, want)
+		rc.Close()
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// parseVia parses a comma-separated list of ss:// URLs of the servers to go
+// through, in order, before reaching the server.
+func parseVia(s string) (*core.Dialer, error) {
+	d := &core.Dialer{Forward: dialNetwork}
+	for _, u := range strings.Split(s, ",") {
+		if !strings.HasPrefix(u, "ss://") {
+			return nil, fmt.Errorf("expecting ss:// URL, got %q", u)
+		}
+		addr, cipher, password, err := parseURL(u)
+		if err != nil {
+			return nil, err
+		}
+		ciph, err := core.PickCipher(cipher, nil, password)
+		if err != nil {
+			return nil, err
+		}
+		d.Hops = append(d.Hops, core.Hop{Server: addr, Cipher: ciph})
+	}
+	return d, nil
+}
+
+// dialNetwork adapts dialTCP to the signature of net.Dial.
+func dialNetwork(network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return net.Dial(network, addr)
+	}
+	return dialTCP(addr)
+}
+
+// Connect to a shadowsocks server, through config.Via if set.
+func dialServer(server string) (net.Conn, error) {
+	if config.Via == nil {
+		return dialTCP(server)
+	}
+	return config.Via.Dial("tcp", server)
+}
+
+// Open a socket for datagrams to shadowsocks servers, through config.Via if set.
+func listenServer() (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil || config.Via == nil {
+		return pc, err
+	}
+	tpc, err := config.Via.PacketConn(pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return tpc, nil
+}
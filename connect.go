@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// replyFlag is set in the address type of the target address a client sends
+// to ask the server to report the outcome of connecting to the target. The
+// server replies on the stream with a SOCKS reply code, followed by the
+// address it connected from if it succeeded, and relays as usual.
+const replyFlag = 0x20
+
+// When deferred SOCKS5 CONNECT replies are sent, see config.DeferReply.
+const (
+	deferToServer = "server" // once connected to the server
+	deferToTarget = "target" // once the server has connected to the target
+)
+
+// Make a connect request for tgt asking the server to reply.
+func replyRequest(tgt socks.Addr) []byte {
+	b := append([]byte(nil), tgt...)
+	b[0] |= replyFlag
+	return b
+}
+
+// Send the deferred CONNECT reply to the SOCKS client c once connected to the
+// server through rc, waiting for the reply of the server if asked for it.
+// Returns the SOCKS error replied, if any.
+func connectReply(c, rc net.Conn, remote bool) error {
+	if !remote {
+		return socks.Reply(c, nil, socks.ParseAddr(rc.LocalAddr().String()))
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		socks.Reply(c, socks.ErrGeneralFailure, nil)
+		return err
+	}
+	if b[0] != 0 {
+		socks.Reply(c, socks.Error(b[0]), nil)
+		return socks.Error(b[0])
+	}
+	bnd, err := socks.ReadAddr(rc)
+	if err != nil {
+		socks.Reply(c, socks.ErrGeneralFailure, nil)
+		return err
+	}
+	return socks.Reply(c, nil, bnd)
+}
+
+// Report the outcome of connecting to the target to client c of the server:
+// rc on success, err otherwise.
+func replyRemote(c, rc net.Conn, err error) error {
+	if err != nil {
+		_, werr := c.Write([]byte{byte(replyError(err))})
+		return werr
+	}
+	_, err = c.Write(append([]byte{0}, socks.ParseAddr(rc.LocalAddr().String())...))
+	return err
+}
+
+// replyError maps a dial error to a SOCKS reply code.
+func replyError(err error) socks.Error {
+	var serr socks.Error
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &serr):
+		return serr
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks.ErrConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks.ErrNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks.ErrHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks.ErrTTLExpired
+	}
+	return socks.ErrGeneralFailure
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// connLimiter caps the number of concurrent connections globally, per client
+// IP and per user. A nil *connLimiter imposes no limits. Zero means unlimited.
+type connLimiter struct {
+	sync.Mutex
+	max, maxPerIP, maxPerUser int
+
+	n     int
+	ips   map[string]int
+	users map[string]int
+}
+
+func newConnLimiter(max, maxPerIP, maxPerUser int) *connLimiter {
+	return &connLimiter{
+		max:        max,
+		maxPerIP:   maxPerIP,
+		maxPerUser: maxPerUser,
+		ips:        make(map[string]int),
+		users:      make(map[string]int),
+	}
+}
+
+// Acquire reserves a slot for connection c accounted to user, or to no user
+// yet if empty. If ok, call release once the connection is closed.
+func (l *connLimiter) Acquire(c net.Conn, user string) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	ip := c.RemoteAddr().String()
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.max > 0 && l.n >= l.max ||
+		l.maxPerIP > 0 && l.ips[ip] >= l.maxPerIP ||
+		user != "" && l.maxPerUser > 0 && l.users[user] >= l.maxPerUser {
+		return nil, false
+	}
+	l.n++
+	l.ips[ip]++
+	if user != "" {
+		l.users[user]++
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(ip, user) }) }, true
+}
+
+// AcquireUser reserves a slot for a connection accounted to user once the user
+// is known, e.g. after authentication. If ok, call release once the
+// connection is closed.
+func (l *connLimiter) AcquireUser(user string) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.maxPerUser > 0 && l.users[user] >= l.maxPerUser {
+		return nil, false
+	}
+	l.users[user]++
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release("", user) }) }, true
+}
+
+// errUserLimit refuses a session whose user is over the connection limit.
+var errUserLimit = errors.New("per-user connection limit reached")
+
+// Admission returns the admit function of a session accepted on laddr, which
+// acquires a slot for the user of sess the first time it is called; see
+// session.Admit. Call release once the connection is closed.
+func (l *connLimiter) Admission(sess *session, laddr string) (admit func() bool, release func()) {
+	var once sync.Once
+	var releaseUser func()
+	ok := false
+	admit = func() bool {
+		once.Do(func() { releaseUser, ok = l.AcquireUser(limitKey(sess.User, laddr)) })
+		return ok
+	}
+	return admit, func() {
+		if ok {
+			releaseUser()
+		}
+	}
+}
+
+// Admit applies the per-user connection limit to the session once its user is
+// known, and reports whether it may go on. Handshakes call it before telling
+// the client it succeeded; later calls repeat the first answer.
+func (s *session) Admit() bool {
+	return s.admit == nil || s.admit()
+}
+
+// release frees the slots of ip and user, each if not empty.
+func (l *connLimiter) release(ip, user string) {
+	l.Lock()
+	defer l.Unlock()
+	if ip != "" {
+		l.n--
+		if l.ips[ip]--; l.ips[ip] <= 0 {
+			delete(l.ips, ip)
+		}
+	}
+	if user != "" {
+		if l.users[user]--; l.users[user] <= 0 {
+			delete(l.users, user)
+		}
+	}
+}
+
+// acceptBackoff spaces out retries after failed Accept calls (e.g. EMFILE)
+// instead of spinning, doubling the delay from 5ms up to 1s.
+type acceptBackoff time.Duration
+
+func (d *acceptBackoff) Wait() {
+	if *d == 0 {
+		*d = acceptBackoff(5 * time.Millisecond)
+	} else {
+		*d *= 2
+	}
+	if max := acceptBackoff(time.Second); *d > max {
+		*d = max
+	}
+	time.Sleep(time.Duration(*d))
+}
+
+func (d *acceptBackoff) Reset() { *d = 0 }
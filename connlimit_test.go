@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestAdmission(t *testing.T) {
+	l := newConnLimiter(0, 0, 1)
+	admit := func(user string) (bool, func()) {
+		sess := newSession("tcp", nil)
+		sess.User = user
+		var release func()
+		sess.admit, release = l.Admission(sess, "127.0.0.1:1080")
+		return sess.Admit() && sess.Admit(), release // counted once
+	}
+
+	ok, release := admit("alice")
+	if !ok {
+		t.Fatal("first connection of alice refused")
+	}
+	if ok, _ := admit("alice"); ok {
+		t.Error("second connection of alice admitted")
+	}
+	if ok, _ := admit(""); !ok {
+		t.Error("anonymous connection refused") // accounted to the listen address
+	}
+	release()
+	if ok, _ := admit("alice"); !ok {
+		t.Error("alice refused after release")
+	}
+}
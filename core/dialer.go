@@ -0,0 +1,130 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Hop is a shadowsocks server and the cipher to talk to it.
+type Hop struct {
+	Server string
+	Cipher Cipher
+}
+
+// Dialer reaches destinations through a chain of shadowsocks servers, each
+// hop tunnelled through the previous ones. A hop only sees the address of the
+// next one.
+type Dialer struct {
+	Hops []Hop
+
+	// Forward connects to the first hop. net.Dial is used if nil.
+	Forward func(network, address string) (net.Conn, error)
+}
+
+var errInvalidAddr = errors.New("invalid address")
+
+// Dial connects to address through all hops, e.g. to a target, or to one more
+// shadowsocks server to be wrapped in its StreamConn.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = net.Dial
+	}
+	if len(d.Hops) == 0 {
+		return forward(network, address)
+	}
+
+	c, err := forward(network, d.Hops[0].Server)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range d.Hops {
+		next := address
+		if i+1 < len(d.Hops) {
+			next = d.Hops[i+1].Server
+		}
+		tgt := socks.ParseAddr(next)
+		if tgt == nil {
+			c.Close()
+			return nil, &net.AddrError{Err: errInvalidAddr.Error(), Addr: next}
+		}
+		c = h.Cipher.StreamConn(c)
+		if _, err := c.Write(tgt); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// PacketConn wraps pc so that datagrams written to an address go through all
+// hops, and replies come back the same way. Addresses may be any net.Addr
+// whose String is a host:port, and are resolved by the last hop.
+func (d *Dialer) PacketConn(pc net.PacketConn) (net.PacketConn, error) {
+	if len(d.Hops) == 0 {
+		return pc, nil
+	}
+	first, err := net.ResolveUDPAddr("udp", d.Hops[0].Server)
+	if err != nil {
+		return nil, err
+	}
+	var server net.Addr = first
+	for i, h := range d.Hops {
+		if i > 0 {
+			server = HostPort(h.Server)
+		}
+		pc = &tunnelPacketConn{PacketConn: h.Cipher.PacketConn(pc), server: server}
+	}
+	return pc, nil
+}
+
+// tunnelPacketConn relays datagrams through a shadowsocks server, prefixing
+// them with their destination address.
+type tunnelPacketConn struct {
+	net.PacketConn // encrypted for server
+	server         net.Addr
+
+	mu  sync.Mutex // guards buf
+	buf []byte     // datagrams read with their source address
+}
+
+func (c *tunnelPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, &net.AddrError{Err: errInvalidAddr.Error(), Addr: addr.String()}
+	}
+	if _, err := c.PacketConn.WriteTo(append(append([]byte(nil), tgt...), b...), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *tunnelPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf == nil {
+		c.buf = make([]byte, 64*1024)
+	}
+	buf := c.buf
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		src := socks.SplitAddr(buf[:n])
+		if src == nil {
+			continue
+		}
+		return copy(b, buf[len(src):n]), HostPort(src.String()), nil
+	}
+}
+
+// HostPort is a UDP address that may hold a host name, left for the far end
+// to resolve.
+type HostPort string
+
+func (a HostPort) Network() string { return "udp" }
+func (a HostPort) String() string  { return string(a) }
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	dnsTimeout   = 5 * time.Second  // per upstream attempt
+	dnsIdleTime  = 30 * time.Second // before closing idle TCP clients
+	dnsCacheSize = 10000            // entries
+	dnsStaleFor  = 24 * time.Hour   // how long expired answers are kept for upstream failures
+	dnsStaleTTL  = 30               // TTL of stale answers in seconds, as suggested by RFC 8767
+)
+
+// dnsForwarder answers DNS queries from its cache, or by forwarding them to
+// upstream resolvers through the shadowsocks server, or to a direct resolver
+// for listed domains. With fakeIP, address queries for other domains are
+// answered from the pool instead.
+type dnsForwarder struct {
+	server       string
+	shadow       func(net.Conn) net.Conn
+	shadowPacket func(net.PacketConn) net.PacketConn
+
+	upstreams []string // reached through the server
+	tcp       bool     // query upstreams over TCP rather than UDP
+
+	direct         *domainSet // domains resolved by directResolver
+	directResolver string
+
+	cache  *dnsCache
+	fakeIP *fakeIPPool
+}
+
+// Serve DNS on addr over UDP and TCP.
+func dnsLocal(addr string, f *dnsForwarder) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	logf("DNS %s <-> %s <-> %s", addr, f.server, strings.Join(f.upstreams, ","))
+	go dnsServeTCP(l, f)
+	dnsServeUDP(pc, f)
+}
+
+func dnsServeUDP(pc net.PacketConn, f *dnsForwarder) {
+	defer pc.Close()
+	for {
+		buf := make([]byte, udpBufSize)
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			logf("DNS read error: %v", err)
+			continue
+		}
+		go func() {
+			if resp := f.Resolve(buf[:n]); resp != nil {
+				pc.WriteTo(resp, raddr)
+			}
+		}()
+	}
+}
+
+func dnsServeTCP(l net.Listener, f *dnsForwarder) {
+	var backoff acceptBackoff
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			logf("failed to accept: %v", err)
+			backoff.Wait()
+			continue
+		}
+		backoff.Reset()
+
+		go func() {
+			defer c.Close()
+			for {
+				c.SetReadDeadline(time.Now().Add(dnsIdleTime))
+				query, err := readDNSStream(c)
+				if err != nil {
+					return
+				}
+				resp := f.Resolve(query)
+				if resp == nil {
+					return
+				}
+				if err := writeDNSStream(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Resolve returns the response to query, or nil if query is malformed.
+func (f *dnsForwarder) Resolve(query []byte) []byte {
+	q, err := parseDNS(query)
+	if err != nil || q.Raw[2]&0x80 != 0 { // not a query
+		return nil
+	}
+	if f.fakeIP != nil && q.Class == dnsClassIN && q.Name != "" && !f.direct.Match(q.Name) {
+		switch q.Type {
+		case dnsTypeA:
+			return dnsAnswer(q, f.fakeIP.Lookup(q.Name), fakeIPTTL)
+		case dnsTypeAAAA: // no records, so that clients use the fake IPv4 address
+			return dnsResponse(q, dnsRcodeSuccess)
+		}
+	}
+	key := fmt.Sprintf("%s/%d/%d", q.Name, q.Type, q.Class)
+
+	e, fresh := f.cache.Get(key)
+	if fresh {
+		return e.Reply(q)
+	}
+
+	resp, err := f.exchange(q)
+	if err != nil {
+		if e != nil {
+			logf("DNS %s: %v, serving stale answer", q.Name, err)
+			return e.msg.Reply(q, 0, dnsStaleTTL)
+		}
+		logf("DNS %s: %v", q.Name, err)
+		return dnsResponse(q, dnsRcodeServFail)
+	}
+	f.cache.Put(key, resp)
+	return resp.Reply(q, 0, 0)
+}
+
+// exchange sends query q to the direct resolver if listed, and otherwise to
+// the upstreams in turn until one answers.
+func (f *dnsForwarder) exchange(q *dnsMsg) (*dnsMsg, error) {
+	if f.direct.Match(q.Name) {
+		return dnsExchange(q, func(b []byte) ([]byte, error) { return exchangeDirect(b, f.directResolver) })
+	}
+	var err error
+	for _, upstream := range f.upstreams {
+		var resp *dnsMsg
+		resp, err = dnsExchange(q, func(b []byte) ([]byte, error) {
+			if f.tcp {
+				return f.exchangeTCP(b, upstream)
+			}
+			resp, err := f.exchangeUDP(b, upstream)
+			if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 { // truncated
+				return f.exchangeTCP(b, upstream)
+			}
+			return resp, err
+		})
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// dnsExchange sends q with exchange and checks that the response matches.
+// Server failures count as errors so that stale answers are preferred.
+func dnsExchange(q *dnsMsg, exchange func([]byte) ([]byte, error)) (*dnsMsg, error) {
+	b, err := exchange(q.Raw)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseDNS(b)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ID() != q.ID() || resp.Name != q.Name || resp.Type != q.Type {
+		return nil, errors.New("mismatched DNS response")
+	}
+	if resp.Rcode() == dnsRcodeServFail {
+		return nil, errors.New("upstream server failure")
+	}
+	return resp, nil
+}
+
+// exchangeTCP sends query to upstream over TCP through the server.
+func (f *dnsForwarder) exchangeTCP(query []byte, upstream string) ([]byte, error) {
+	tgt := socks.ParseAddr(upstream)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid upstream %q", upstream)
+	}
+	rc, err := dialServer(f.server)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	rc.SetDeadline(time.Now().Add(dnsTimeout))
+	rc = f.shadow(rc)
+	// the target address and the query leave together
+	b := make([]byte, len(tgt)+2+len(query))
+	copy(b, tgt)
+	binary.BigEndian.PutUint16(b[len(tgt):], uint16(len(query)))
+	copy(b[len(tgt)+2:], query)
+	if _, err := rc.Write(b); err != nil {
+		return nil, err
+	}
+	return readDNSStream(rc)
+}
+
+// exchangeUDP sends query to upstream over UDP through the server.
+func (f *dnsForwarder) exchangeUDP(query []byte, upstream string) ([]byte, error) {
+	tgt := socks.ParseAddr(upstream)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid upstream %q", upstream)
+	}
+	srvAddr, err := net.ResolveUDPAddr("udp", f.server)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := listenServer()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(dnsTimeout))
+	pc = f.shadowPacket(pc)
+	if _, err := pc.WriteTo(append(append([]byte(nil), tgt...), query...), srvAddr); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpBufSize)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	src := socks.SplitAddr(buf[:n])
+	if src == nil {
+		return nil, errors.New("missing source address")
+	}
+	return buf[len(src):n], nil
+}
+
+// exchangeDirect sends query to resolver over UDP, retrying over TCP if the
+// response is truncated.
+func exchangeDirect(query []byte, resolver string) ([]byte, error) {
+	c, err := net.DialTimeout("udp", resolver, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpBufSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 3 || buf[2]&0x02 == 0 { // not truncated
+		return buf[:n], nil
+	}
+
+	tc, err := net.DialTimeout("tcp", resolver, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+	return exchangeStream(tc, query)
+}
+
+// exchangeStream sends query over stream c and reads the response.
+func exchangeStream(c net.Conn, query []byte) ([]byte, error) {
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := writeDNSStream(c, query); err != nil {
+		return nil, err
+	}
+	return readDNSStream(c)
+}
+
+// readDNSStream reads a message prefixed with its length, as over TCP.
+func readDNSStream(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(n[:]))
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// writeDNSStream writes message b prefixed with its length, as over TCP.
+func writeDNSStream(w io.Writer, b []byte) error {
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// dnsEntry is a cached response.
+type dnsEntry struct {
+	msg     *dnsMsg
+	stored  time.Time
+	expires time.Time
+}
+
+// Reply returns the cached response to query q with aged TTLs.
+func (e *dnsEntry) Reply(q *dnsMsg) []byte {
+	return e.msg.Reply(q, uint32(time.Since(e.stored)/time.Second), 0)
+}
+
+// dnsCache holds responses until their lowest TTL runs out, and for
+// dnsStaleFor more as a fallback. Responses without records are not cached.
+// The least recently used ones make room for new ones.
+type dnsCache struct {
+	sync.Mutex
+	lru *lruCache // of *dnsEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{lru: newLRUCache(dnsCacheSize)}
+}
+
+// Get returns the entry under key, if any, and whether it is still fresh.
+func (c *dnsCache) Get(key string) (*dnsEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*dnsEntry)
+	now := time.Now()
+	if now.After(e.expires.Add(dnsStaleFor)) {
+		c.lru.Del(key)
+		return nil, false
+	}
+	return e, now.Before(e.expires)
+}
+
+// Put caches response m under key.
+func (c *dnsCache) Put(key string, m *dnsMsg) {
+	if m.Truncated() || m.Rcode() != dnsRcodeSuccess && m.Rcode() != dnsRcodeNXDomain {
+		return
+	}
+	ttl, ok := m.MinTTL()
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	c.lru.Put(key, &dnsEntry{msg: m, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)})
+}
+
+// domainSet matches domain names and their subdomains against a list. A nil
+// *domainSet matches nothing.
+type domainSet struct {
+	sync.RWMutex
+	path    string
+	domains map[string]bool
+}
+
+func newDomainSet(path string) (*domainSet, error) {
+	s := &domainSet{path: path}
+	return s, s.Load()
+}
+
+// Load (re)reads the domain list file, one domain per line.
+func (s *domainSet) Load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	domains := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		domains[strings.Trim(strings.ToLower(fields[0]), ".")] = true
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.domains = domains
+	s.Unlock()
+	return nil
+}
+
+// Match reports whether name or one of its parent domains is listed.
+func (s *domainSet) Match(name string) bool {
+	if s == nil {
+		return false
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	s.RLock()
+	defer s.RUnlock()
+	for {
+		if s.domains[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Just enough of RFC 1035 messages to answer, cache and forward queries.
+
+// DNS record types and response codes used here.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+
+	dnsClassIN = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+const dnsHeaderLen = 12
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// dnsRR is a resource record of a parsed message.
+type dnsRR struct {
+	Name   string
+	Type   uint16
+	Class  uint16
+	TTL    uint32
+	Data   []byte // RDATA, sliced from the message
+	ttlOff int    // offset of the TTL field in the message
+}
+
+// dnsMsg is a parsed DNS message holding its first question.
+type dnsMsg struct {
+	Raw    []byte
+	Name   string // question name, lower case without the final dot
+	Type   uint16 // question type
+	Class  uint16 // question class
+	qEnd   int    // end offset of the question section
+	Record []dnsRR
+	Answer []dnsRR // the answer section, leading Record
+}
+
+// parseDNS parses message b, which must hold exactly one question.
+func parseDNS(b []byte) (*dnsMsg, error) {
+	if len(b) < dnsHeaderLen || binary.BigEndian.Uint16(b[4:]) != 1 {
+		return nil, errDNSMessage
+	}
+	m := &dnsMsg{Raw: b}
+	name, off, err := readDNSName(b, dnsHeaderLen)
+	if err != nil || off+4 > len(b) {
+		return nil, errDNSMessage
+	}
+	m.Name = strings.ToLower(name)
+	m.Type = binary.BigEndian.Uint16(b[off:])
+	m.Class = binary.BigEndian.Uint16(b[off+2:])
+	off += 4
+	m.qEnd = off
+
+	n := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	for i := 0; i < n; i++ {
+		var rr dnsRR
+		rr.Name, off, err = readDNSName(b, off)
+		if err != nil || off+10 > len(b) {
+			return nil, errDNSMessage
+		}
+		rr.Type = binary.BigEndian.Uint16(b[off:])
+		rr.Class = binary.BigEndian.Uint16(b[off+2:])
+		rr.TTL = binary.BigEndian.Uint32(b[off+4:])
+		rr.ttlOff = off + 4
+		end := off + 10 + int(binary.BigEndian.Uint16(b[off+8:]))
+		if end > len(b) {
+			return nil, errDNSMessage
+		}
+		rr.Data = b[off+10 : end]
+		off = end
+		m.Record = append(m.Record, rr)
+	}
+	m.Answer = m.Record[:binary.BigEndian.Uint16(b[6:])]
+	return m, nil
+}
+
+// readDNSName reads the possibly compressed name at off in message b. Returns
+// the name and the offset following it.
+func readDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1 // offset after the name, once a pointer was followed
+	for hops := 0; ; {
+		if off >= len(b) {
+			return "", 0, errDNSMessage
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xC0 == 0xC0: // pointer
+			if off+2 > len(b) || hops > 64 {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			hops++
+		case l&0xC0 != 0:
+			return "", 0, errDNSMessage
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// ID returns the message ID.
+func (m *dnsMsg) ID() uint16 { return binary.BigEndian.Uint16(m.Raw) }
+
+// Rcode returns the response code.
+func (m *dnsMsg) Rcode() int { return int(m.Raw[3] & 0x0F) }
+
+// Truncated reports whether the TC bit is set.
+func (m *dnsMsg) Truncated() bool { return m.Raw[2]&0x02 != 0 }
+
+// MinTTL returns the lowest TTL of the records other than OPT, and false if
+// there are none.
+func (m *dnsMsg) MinTTL() (uint32, bool) {
+	var min uint32
+	ok := false
+	for _, rr := range m.Record {
+		if rr.Type == dnsTypeOPT {
+			continue
+		}
+		if !ok || rr.TTL < min {
+			min, ok = rr.TTL, true
+		}
+	}
+	return min, ok
+}
+
+// Reply returns a copy of response m answering query q, with the TTL of
+// records other than OPT lowered by age, or set to ttl if ttl is not zero.
+func (m *dnsMsg) Reply(q *dnsMsg, age, ttl uint32) []byte {
+	b := append([]byte(nil), m.Raw...)
+	binary.BigEndian.PutUint16(b, q.ID())
+	if m.qEnd == q.qEnd { // same question but maybe for the case of the name
+		copy(b[dnsHeaderLen:m.qEnd], q.Raw[dnsHeaderLen:q.qEnd])
+	}
+	for _, rr := range m.Record {
+		if rr.Type == dnsTypeOPT {
+			continue
+		}
+		t := ttl
+		if t == 0 && rr.TTL > age {
+			t = rr.TTL - age
+		}
+		binary.BigEndian.PutUint32(b[rr.ttlOff:], t)
+	}
+	return b
+}
+
+// dnsResponse returns an empty response to query m with the given response code.
+func dnsResponse(m *dnsMsg, rcode int) []byte {
+	b := append([]byte(nil), m.Raw[:m.qEnd]...)
+	b[2] |= 0x80                          // QR
+	b[3] = 0x80 | byte(rcode)             // RA, RCODE
+	binary.BigEndian.PutUint16(b[6:], 0)  // ANCOUNT
+	binary.BigEndian.PutUint16(b[8:], 0)  // NSCOUNT
+	binary.BigEndian.PutUint16(b[10:], 0) // ARCOUNT
+	return b
+}
+
+// dnsAnswer returns a response to query m with an A record of ip.
+func dnsAnswer(m *dnsMsg, ip net.IP, ttl uint32) []byte {
+	b := dnsResponse(m, dnsRcodeSuccess)
+	binary.BigEndian.PutUint16(b[6:], 1)
+	rr := make([]byte, 16)
+	binary.BigEndian.PutUint16(rr, 0xC000|dnsHeaderLen) // the question name
+	binary.BigEndian.PutUint16(rr[2:], dnsTypeA)
+	binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+	binary.BigEndian.PutUint32(rr[6:], ttl)
+	binary.BigEndian.PutUint16(rr[10:], net.IPv4len)
+	copy(rr[12:], ip.To4())
+	return append(b, rr...)
+}
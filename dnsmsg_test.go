@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseDNSQuery(t *testing.T) {
+	b, err := dnsQuery("Example.COM.", dnsTypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseDNS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "example.com" || m.Type != dnsTypeAAAA || m.Class != dnsClassIN {
+		t.Errorf("question: %q %d %d", m.Name, m.Type, m.Class)
+	}
+	if len(m.Record) != 1 || m.Record[0].Type != dnsTypeOPT || len(m.Answer) != 0 {
+		t.Errorf("records: %+v, answers: %+v", m.Record, m.Answer)
+	}
+	if _, ok := m.MinTTL(); ok {
+		t.Error("MinTTL counts the OPT record")
+	}
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	b, _ := dnsQuery("example.com", dnsTypeA)
+	q, err := parseDNS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseDNS(dnsAnswer(q, net.IPv4(1, 2, 3, 4), 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 1 {
+		t.Fatalf("%d answers", len(m.Answer))
+	}
+	rr := m.Answer[0]
+	if rr.Name != "example.com" || rr.Type != dnsTypeA || rr.TTL != 300 || !bytes.Equal(rr.Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("answer: %+v", rr)
+	}
+	if ttl, ok := m.MinTTL(); !ok || ttl != 300 {
+		t.Errorf("MinTTL = %d, %v", ttl, ok)
+	}
+
+	b, _ = dnsQuery("EXAMPLE.com", dnsTypeA)
+	q2, _ := parseDNS(b)
+	r, err := parseDNS(m.Reply(q2, 100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID() != q2.ID() || r.Answer[0].TTL != 200 || !bytes.Equal(r.Raw[dnsHeaderLen:r.qEnd], q2.Raw[dnsHeaderLen:q2.qEnd]) {
+		t.Errorf("reply: ID %d, TTL %d, question %q", r.ID(), r.Answer[0].TTL, r.Raw[dnsHeaderLen:r.qEnd])
+	}
+
+	// every truncation is rejected rather than read past
+	for n := 0; n < len(m.Raw); n++ {
+		if _, err := parseDNS(m.Raw[:n]); err == nil {
+			t.Errorf("parsed message truncated to %d bytes", n)
+		}
+	}
+}
+
+func TestReadDNSName(t *testing.T) {
+	hdr := make([]byte, dnsHeaderLen)
+	msg := func(b ...byte) []byte { return append(append([]byte(nil), hdr...), b...) }
+	tests := []struct {
+		name string
+		b    []byte
+		off  int
+		want string
+		next int // offset after the name, 0 if invalid
+	}{
+		{"root", msg(0), 12, "", 13},
+		{"labels", msg(1, 'a', 2, 'b', 'c', 0), 12, "a.bc", 18},
+		{"pointer", msg(1, 'a', 0, 1, 'b', 0xC0, 12), 15, "b.a", 19},
+		{"pointer to pointer", msg(1, 'a', 0, 0xC0, 12, 1, 'b', 0xC0, 15), 17, "b.a", 21},
+		{"pointer loop", msg(0xC0, 12), 12, "", 0},
+		{"pointer pair loop", msg(0xC0, 14, 0xC0, 12), 12, "", 0},
+		{"pointer past the end", msg(0xC0, 99), 12, "", 0},
+		{"truncated pointer", msg(0xC0), 12, "", 0},
+		{"truncated label", msg(5, 'a', 'b'), 12, "", 0},
+		{"no terminator", msg(1, 'a'), 12, "", 0},
+		{"reserved label type", msg(0x40, 0), 12, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, next, err := readDNSName(tt.b, tt.off)
+			if tt.next == 0 {
+				if err == nil {
+					t.Errorf("got %q, want error", name)
+				}
+				return
+			}
+			if err != nil || name != tt.want || next != tt.next {
+				t.Errorf("got %q %d %v, want %q %d", name, next, err, tt.want, tt.next)
+			}
+		})
+	}
+}
+
+func TestDNSQueryName(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	for _, name := range []string{"", ".", "a..com", ".a.com", "a." + long + ".com", strings.Repeat("a.", 127) + "a"} {
+		if _, err := dnsQuery(name, dnsTypeA); err == nil {
+			t.Errorf("query for %q", name)
+		}
+	}
+	for _, name := range []string{"com", "example.com.", long[1:] + ".com"} {
+		if _, err := dnsQuery(name, dnsTypeA); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+
+	// the lookup fails instead of asking for another name
+	r, err := newResolver("127.0.0.1:1", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupIP("a." + long + ".com"); err == nil || !strings.Contains(err.Error(), errDNSName.Error()) {
+		t.Errorf("lookup of an overlong label: %v", err)
+	}
+}
+
+func TestParseDNSMalformed(t *testing.T) {
+	q, _ := dnsQuery("example.com", dnsTypeA)
+	two := append([]byte(nil), q...)
+	two[5] = 2 // QDCOUNT
+	more := append([]byte(nil), q...)
+	more[7] = 1 // ANCOUNT past the end
+	for name, b := range map[string][]byte{"short header": q[:11], "two questions": two, "missing records": more} {
+		if _, err := parseDNS(b); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// attemptTimeout bounds the connection attempts to all but the last address
+// when they are tried in turn.
+const attemptTimeout = 5 * time.Second
+
+// resolutionDelay is how long a race waits for IPv6 addresses once the IPv4
+// ones are in (RFC 8305 section 3).
+const resolutionDelay = 50 * time.Millisecond
+
+// Dial connects to the host:port address over TCP. The addresses of host are
+// tried in turn, or raced as in RFC 8305 with the race strategy. Without a
+// strategy, upstreams or override, host is left to package net and its own
+// dual-stack fallback.
+func (r *resolver) Dial(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.strategy == "" && len(r.upstreams) == 0 {
+		if _, ok := r.hosts.Lookup(strings.TrimSuffix(strings.ToLower(host), ".")); !ok {
+			return net.Dial("tcp", addr)
+		}
+	}
+	if r.strategy == raceIPs && net.ParseIP(host) == nil {
+		return r.raceDial(host, port)
+	}
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+
+	var errs dialErrors
+	for i, ip := range ips {
+		var d net.Dialer
+		if i < len(ips)-1 {
+			d.Timeout = attemptTimeout
+		}
+		c, err := d.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		errs.Add(ip, err)
+	}
+	return nil, errs.Err()
+}
+
+// raceDial connects to one of the addresses of host at port. Attempts start
+// once the IPv6 addresses are in, or resolutionDelay after the IPv4 ones if
+// those come first, then every raceDelay or as soon as the last one failed.
+// Addresses resolved later join the race. The first connection wins.
+func (r *resolver) raceDial(host, port string) (net.Conn, error) {
+	answers, lookups := r.lookupTypes(host)
+	var queue []net.IP
+	var lookupErr error
+	found := func(a resolverAnswer) {
+		lookups--
+		queue = r.order(append(queue, a.ips...))
+		if lookupErr == nil {
+			lookupErr = a.err
+		}
+	}
+	var resolved <-chan time.Time
+wait:
+	for lookups > 0 {
+		select {
+		case a := <-answers:
+			found(a)
+			if len(queue) > 0 && a.qtype == dnsTypeAAAA {
+				break wait
+			}
+			if len(queue) > 0 && resolved == nil {
+				resolved = time.After(resolutionDelay)
+			}
+		case <-resolved:
+			break wait
+		}
+	}
+	if len(queue) == 0 {
+		if lookupErr == nil {
+			lookupErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: lookupErr}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		ip  net.IP
+		err error
+	}
+	results := make(chan result)
+	var d net.Dialer
+	pending, due := 0, false
+	timer := time.NewTimer(r.raceDelay)
+	defer timer.Stop()
+	start := func() {
+		ip := queue[0]
+		queue = queue[1:]
+		pending++
+		due = false
+		go func() {
+			c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- result{c, ip, err}
+		}()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(r.raceDelay)
+	}
+	next := func() {
+		if len(queue) > 0 {
+			start()
+		} else {
+			due = true
+		}
+	}
+
+	var errs dialErrors
+	start()
+	for pending > 0 || lookups > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(n int) { // close the losers that connected anyway
+					for ; n > 0; n-- {
+						if res := <-results; res.c != nil {
+							res.c.Close()
+						}
+					}
+				}(pending)
+				return res.c, nil
+			}
+			errs.Add(res.ip, res.err)
+			next()
+		case <-timer.C:
+			next()
+		case a := <-answers:
+			found(a)
+			if due && len(queue) > 0 {
+				start()
+			}
+		}
+	}
+	return nil, errs.Err()
+}
+
+// dialErrors collects why connecting failed, by address family.
+type dialErrors struct {
+	first, v4, v6 error
+}
+
+func (e *dialErrors) Add(ip net.IP, err error) {
+	if e.first == nil {
+		e.first = err
+	}
+	if ip.To4() != nil {
+		e.v4 = err
+	} else {
+		e.v6 = err
+	}
+}
+
+// Err returns the error to report, nil if none was added.
+func (e *dialErrors) Err() error {
+	if e.v4 == nil || e.v6 == nil {
+		return e.first // a single family needs no labels
+	}
+	return e
+}
+
+func (e *dialErrors) Error() string {
+	return "ipv6: " + e.v6.Error() + "; ipv4: " + e.v4.Error()
+}
+
+// Unwrap returns the error of the family tried first.
+func (e *dialErrors) Unwrap() error { return e.first }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// stubDNS answers A queries with v4 at once and AAAA queries with v6 after
+// aaaaDelay.
+func stubDNS(t *testing.T, v4, v6 net.IP, aaaaDelay time.Duration) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := parseDNS(append([]byte(nil), buf[:n]...))
+			if err != nil {
+				continue
+			}
+			if m.Type == dnsTypeA {
+				pc.WriteTo(dnsAnswer(m, v4, 60), addr)
+				continue
+			}
+			b := dnsAnswer(m, net.IPv4zero, 60)
+			rr := b[len(b)-16:]
+			binary.BigEndian.PutUint16(rr[2:], dnsTypeAAAA)
+			binary.BigEndian.PutUint16(rr[10:], net.IPv6len)
+			b = append(b[:len(b)-4], v6.To16()...)
+			time.AfterFunc(aaaaDelay, func() { pc.WriteTo(b, addr) })
+		}
+	}()
+	return pc
+}
+
+func TestRaceDial(t *testing.T) {
+	ln6, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	defer ln6.Close()
+	port := ln6.Addr().(*net.TCPAddr).Port
+	ln4, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln4.Close()
+	go acceptAll(ln6)
+	go acceptAll(ln4)
+	unreachable := net.IPv4(127, 0, 0, 2) // nothing listens there
+
+	tests := []struct {
+		name      string
+		v4        net.IP
+		aaaaDelay time.Duration
+		want      string
+	}{
+		{"AAAA within the resolution delay", net.IPv4(127, 0, 0, 1), 10 * time.Millisecond, "::1"},
+		{"AAAA late", net.IPv4(127, 0, 0, 1), 2 * time.Second, "127.0.0.1"},
+		{"AAAA joins after IPv4 failed", unreachable, 300 * time.Millisecond, "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dns := stubDNS(t, tt.v4, net.IPv6loopback, tt.aaaaDelay)
+			defer dns.Close()
+			r, err := newResolver(dns.LocalAddr().String(), raceIPs, 250*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			begin := time.Now()
+			c, err := r.Dial(net.JoinHostPort("example.com", strconv.Itoa(port)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if ip := c.RemoteAddr().(*net.TCPAddr).IP.String(); ip != tt.want {
+				t.Errorf("connected to %s, want %s", ip, tt.want)
+			}
+			if d := time.Since(begin); d > time.Second {
+				t.Errorf("took %v", d)
+			}
+		})
+	}
+}
+
+func acceptAll(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+	}
+}
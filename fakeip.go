@@ -0,0 +1,200 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// fakeIPTTL is the TTL of fake answers in seconds, short so that clients come
+// back and keep their mapping recently used.
+const fakeIPTTL = 1
+
+var errUnknownFakeIP = errors.New("fake IP not mapped to a domain")
+
+// fakeIPPool hands out addresses of an IPv4 range to domain names and maps
+// them back, recycling the least recently used ones when exhausted. A nil
+// *fakeIPPool maps nothing.
+type fakeIPPool struct {
+	sync.Mutex
+	net   *net.IPNet
+	base  uint32 // first address handed out
+	size  uint32 // number of addresses handed out
+	next  uint32 // offset of the next never used address
+	names map[string]*list.Element
+	ips   map[uint32]*list.Element
+	lru   list.List // of *fakeIP, most recently used first
+}
+
+type fakeIP struct {
+	name string
+	off  uint32
+}
+
+// newFakeIPPool returns a pool of the addresses in cidr, but for the network
+// and broadcast addresses.
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("fake IP range %s is not an IPv4 range of 4 addresses or more", cidr)
+	}
+	return &fakeIPPool{
+		net:   n,
+		base:  binary.BigEndian.Uint32(n.IP.To4()) + 1,
+		size:  1<<uint(32-ones) - 2,
+		names: make(map[string]*list.Element),
+		ips:   make(map[uint32]*list.Element),
+	}, nil
+}
+
+// Lookup returns the fake IP of domain name, mapping one if needed.
+func (p *fakeIPPool) Lookup(name string) net.IP {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.names[name]
+	if ok {
+		p.lru.MoveToFront(e)
+	} else {
+		var off uint32
+		if p.next < p.size {
+			off = p.next
+			p.next++
+		} else {
+			e = p.lru.Back()
+			old := p.lru.Remove(e).(*fakeIP)
+			delete(p.names, old.name)
+			delete(p.ips, old.off)
+			off = old.off
+		}
+		e = p.lru.PushFront(&fakeIP{name: name, off: off})
+		p.names[name] = e
+		p.ips[off] = e
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.base+e.Value.(*fakeIP).off)
+	return ip
+}
+
+// Target translates tgt to the domain name its fake IP stands for. Targets
+// out of the pool are returned as is.
+func (p *fakeIPPool) Target(tgt socks.Addr) (socks.Addr, error) {
+	if p == nil || tgt[0] != socks.AtypIPv4 {
+		return tgt, nil
+	}
+	ip := net.IP(tgt[1 : 1+net.IPv4len])
+	if !p.net.Contains(ip) {
+		return tgt, nil
+	}
+	p.Lock()
+	e, ok := p.ips[binary.BigEndian.Uint32(ip)-p.base]
+	p.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%v: %v", ip, errUnknownFakeIP)
+	}
+	port := int(tgt[1+net.IPv4len])<<8 | int(tgt[1+net.IPv4len+1])
+	return socks.ParseAddr(net.JoinHostPort(e.Value.(*fakeIP).name, strconv.Itoa(port))), nil
+}
+
+// fakeIPPacketConn sends datagrams to fake IPs to the domain names they stand
+// for, and makes replies to them come from the fake IPs. Datagrams are
+// prefixed with their target or source address.
+type fakeIPPacketConn struct {
+	net.PacketConn
+	pool    *fakeIPPool
+	sources replySources
+}
+
+func (c *fakeIPPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.SplitAddr(b)
+	if tgt == nil {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	dst, err := c.pool.Target(tgt)
+	if err != nil {
+		return 0, err
+	}
+	if dst[0] != socks.AtypDomainName {
+		c.sources.Add(tgt, false)
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	c.sources.Add(tgt, true)
+	if _, err := c.PacketConn.WriteTo(append(append([]byte(nil), dst...), b[len(tgt):]...), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *fakeIPPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	return c.sources.Rewrite(b, n), addr, nil
+}
+
+// replySources makes replies to datagrams sent to domain names in place of IP
+// targets come from those IP targets. Replies only carry the address the
+// domain resolved to, so they are matched by port, unless several IP targets
+// share it or the reply comes from an IP target sent to as is.
+type replySources struct {
+	sync.Mutex
+	ports  map[uint16]map[string]bool // IP targets sent to by domain, by port
+	direct map[string]bool            // IP targets sent to as is
+}
+
+func addrPort(a socks.Addr) uint16 { return uint16(a[len(a)-2])<<8 | uint16(a[len(a)-1]) }
+
+// Add records IP target tgt as sent to by domain name or as is.
+func (s *replySources) Add(tgt socks.Addr, byDomain bool) {
+	s.Lock()
+	defer s.Unlock()
+	if !byDomain {
+		if s.direct == nil {
+			s.direct = make(map[string]bool)
+		}
+		s.direct[string(tgt)] = true
+		return
+	}
+	if s.ports == nil {
+		s.ports = make(map[uint16]map[string]bool)
+	}
+	port := addrPort(tgt)
+	if s.ports[port] == nil {
+		s.ports[port] = make(map[string]bool)
+	}
+	s.ports[port][string(tgt)] = true
+}
+
+// Rewrite replaces the source address prefixing the datagram b[:n] with the IP
+// target it replies to, if known. Returns the new length of the datagram.
+func (s *replySources) Rewrite(b []byte, n int) int {
+	src := socks.SplitAddr(b[:n])
+	if src == nil {
+		return n
+	}
+	s.Lock()
+	tgts := s.ports[addrPort(src)]
+	var tgt socks.Addr
+	if len(tgts) == 1 && !tgts[string(src)] && !s.direct[string(src)] {
+		for t := range tgts {
+			tgt = socks.Addr(t)
+		}
+	}
+	s.Unlock()
+	if tgt == nil || n-len(src)+len(tgt) > len(b) {
+		return n
+	}
+	copy(b[len(tgt):], b[len(src):n])
+	copy(b, tgt)
+	return n - len(src) + len(tgt)
+}
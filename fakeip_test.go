@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	p, err := newFakeIPPool("198.18.0.0/30") // 2 usable addresses
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := p.Lookup("a.example"), p.Lookup("b.example")
+	if !a.Equal(net.IPv4(198, 18, 0, 1)) || !b.Equal(net.IPv4(198, 18, 0, 2)) {
+		t.Fatalf("got %v %v", a, b)
+	}
+	if ip := p.Lookup("a.example"); !ip.Equal(a) {
+		t.Errorf("a.example remapped to %v", ip)
+	}
+	if ip := p.Lookup("c.example"); !ip.Equal(b) { // b is the least recently used
+		t.Errorf("c.example got %v, want %v", ip, b)
+	}
+
+	tgt, err := p.Target(socks.ParseAddr("198.18.0.2:443"))
+	if err != nil || tgt.String() != "c.example:443" {
+		t.Errorf("Target = %v, %v", tgt, err)
+	}
+	if _, err := p.Target(socks.ParseAddr("198.18.0.3:443")); err == nil {
+		t.Error("unmapped fake IP translated")
+	}
+	if tgt, err := p.Target(socks.ParseAddr("1.2.3.4:443")); err != nil || tgt.String() != "1.2.3.4:443" {
+		t.Errorf("Target of a real IP = %v, %v", tgt, err)
+	}
+	var nilPool *fakeIPPool
+	if tgt, err := nilPool.Target(socks.ParseAddr("198.18.0.1:443")); err != nil || tgt.String() != "198.18.0.1:443" {
+		t.Errorf("nil pool Target = %v, %v", tgt, err)
+	}
+}
+
+// packetRecorder is a net.PacketConn recording writes and replaying reads.
+type packetRecorder struct {
+	net.PacketConn
+	written [][]byte
+	replies [][]byte
+}
+
+func (c *packetRecorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *packetRecorder) ReadFrom(b []byte) (int, net.Addr, error) {
+	n := copy(b, c.replies[0])
+	c.replies = c.replies[1:]
+	return n, nil, nil
+}
+
+func TestFakeIPPacketConn(t *testing.T) {
+	p, _ := newFakeIPPool("198.18.0.0/16")
+	fake := p.Lookup("a.example")
+	inner := &packetRecorder{}
+	c := &fakeIPPacketConn{PacketConn: inner, pool: p}
+
+	fakeTgt := socks.ParseAddr(net.JoinHostPort(fake.String(), "443"))
+	realTgt := socks.ParseAddr("1.2.3.4:53")
+	c.WriteTo(append(append([]byte(nil), fakeTgt...), "hello"...), nil)
+	c.WriteTo(append(append([]byte(nil), realTgt...), "query"...), nil)
+	if got := string(inner.written[0]); got != string(socks.ParseAddr("a.example:443"))+"hello" {
+		t.Errorf("sent %q to a fake IP", got)
+	}
+	if got := string(inner.written[1]); got != string(realTgt)+"query" {
+		t.Errorf("sent %q to a real IP", got)
+	}
+
+	reply := func(src string, payload string) []byte {
+		inner.replies = append(inner.replies, append(append([]byte(nil), socks.ParseAddr(src)...), payload...))
+		b := make([]byte, 512)
+		n, _, _ := c.ReadFrom(b)
+		return b[:n]
+	}
+	// the server tells the address the domain resolved to
+	if got := reply("93.184.216.34:443", "hi"); !bytes.Equal(got, append(append([]byte(nil), fakeTgt...), "hi"...)) {
+		t.Errorf("reply from the domain: %q", got)
+	}
+	if got := reply("1.2.3.4:53", "answer"); !bytes.Equal(got, append(append([]byte(nil), realTgt...), "answer"...)) {
+		t.Errorf("reply from a real IP: %q", got)
+	}
+
+	// replies from IP targets sent to as is are left alone
+	c.WriteTo(append(socks.ParseAddr("5.6.7.8:443"), "x"...), nil)
+	if got := reply("5.6.7.8:443", "hi"); !bytes.Equal(got, append(socks.ParseAddr("5.6.7.8:443"), "hi"...)) {
+		t.Errorf("reply from a real IP on a shared port rewritten: %q", got)
+	}
+
+	// a second fake IP on the same port makes replies ambiguous
+	other := socks.ParseAddr(net.JoinHostPort(p.Lookup("b.example").String(), "443"))
+	c.WriteTo(append(append([]byte(nil), other...), "hello"...), nil)
+	if got := reply("93.184.216.34:443", "hi"); !bytes.Equal(got, append(socks.ParseAddr("93.184.216.34:443"), "hi"...)) {
+		t.Errorf("ambiguous reply rewritten: %q", got)
+	}
+
+	if _, err := c.WriteTo(append(socks.ParseAddr("198.18.200.1:443"), "x"...), nil); err == nil {
+		t.Error("sent to an unmapped fake IP")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/netutil"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Create an HTTP proxy server listening on addr and proxy to server.
+func httpLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+	logf("HTTP proxy %s <-> %s", addr, server)
+	tcpLocal(addr, server, shadow, httpHandshake, refuseHTTP)
+}
+
+// Tell an HTTP proxy client that it is over the connection limits.
+func refuseHTTP(c net.Conn) {
+	io.WriteString(c, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\n\r\n")
+}
+
+// Headers meant for the proxy only. Connection is replaced to make the origin
+// server close after one response, as later requests may go elsewhere.
+var proxyHeaders = []string{"Proxy-Connection", "Proxy-Authorization", "Connection", "Keep-Alive"}
+
+// httpHandshake reads a CONNECT or absolute-URI HTTP proxy request from c and
+// returns its target. For CONNECT the client is told the tunnel is
+// established; for plain HTTP the request header is rewritten to origin form
+// and replayed in front of the request body.
+func httpHandshake(c net.Conn, sess *session) (net.Conn, socks.Addr, error) {
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br) // within the deadline set by serveLocal
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if creds := config.Credentials; creds != nil {
+		user, password, ok := proxyBasicAuth(req)
+		if !ok || !creds.Valid(user, password) {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"shadowsocks\"\r\nConnection: close\r\n\r\n")
+			return nil, nil, errors.New("HTTP proxy authentication failed")
+		}
+		sess.User = user
+	}
+	if !sess.Admit() {
+		refuseHTTP(c)
+		return nil, nil, errUserLimit
+	}
+
+	if req.Method == http.MethodConnect {
+		tgt := socks.ParseAddr(req.Host)
+		if tgt == nil {
+			io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+			return nil, nil, fmt.Errorf("invalid CONNECT target %q", req.Host)
+		}
+		if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return nil, nil, err
+		}
+		return &readerConn{Conn: c, r: br}, tgt, nil // the client may have sent data already
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, nil, errors.New("not an HTTP proxy request: " + req.RequestURI)
+	}
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+	}
+	tgt := socks.ParseAddr(host)
+	if tgt == nil {
+		io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, nil, fmt.Errorf("invalid HTTP target %q", req.URL.Host)
+	}
+
+	upgrade := req.Header.Get("Upgrade") != ""
+	for _, h := range proxyHeaders {
+		req.Header.Del(h)
+	}
+	if upgrade {
+		req.Header.Set("Connection", "Upgrade")
+	} else {
+		req.Header.Set("Connection", "close")
+	}
+	if len(req.TransferEncoding) > 0 { // removed from the header by ReadRequest
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+
+	var hdr bytes.Buffer
+	fmt.Fprintf(&hdr, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	req.Header.Write(&hdr)
+	hdr.WriteString("\r\n")
+
+	// The body, if any, is still unread in br.
+	return &readerConn{Conn: c, r: io.MultiReader(&hdr, br)}, tgt, nil
+}
+
+// proxyBasicAuth returns the credentials from the Proxy-Authorization header.
+func proxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	// Borrow the Authorization parser of net/http.
+	r := http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+// readerConn is a net.Conn whose reads come from r, typically replaying
+// buffered bytes before the rest of the embedded net.Conn.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *readerConn) CloseWrite() error { return netutil.CloseWrite(c.Conn) }
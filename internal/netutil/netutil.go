@@ -0,0 +1,39 @@
+// Package netutil holds connection helpers shared by the cipher packages.
+package netutil
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// PrefixWriter sends Prefix along with the first write so that both leave in
+// a single segment, which lets them fit in a TCP Fast Open SYN.
+type PrefixWriter struct {
+	io.Writer
+	Prefix []byte
+}
+
+func (w *PrefixWriter) Write(b []byte) (int, error) {
+	if w.Prefix == nil {
+		return w.Writer.Write(b)
+	}
+	p := w.Prefix
+	w.Prefix = nil
+	n, err := w.Writer.Write(append(p, b...))
+	if n -= len(p); n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// ErrCloseWrite occurs when the underlying net.Conn cannot half-close.
+var ErrCloseWrite = errors.New("underlying connection does not support CloseWrite")
+
+// CloseWrite shuts down the writing side of c, e.g. a *net.TCPConn.
+func CloseWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrCloseWrite
+}
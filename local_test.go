@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// freeAddr returns a loopback address with a port free for TCP at the time.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitListening waits for a TCP listener on addr.
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("nothing listening on %s", addr)
+}
+
+// testHandshakeTimeout replaces handshakeTimeout for the local proxies.
+const testHandshakeTimeout = 500 * time.Millisecond
+
+// localProxies are the addresses of the local proxies under test.
+type localProxies struct {
+	socks, mixed, http string
+}
+
+var localOnce struct {
+	sync.Once
+	addrs localProxies
+	err   error
+}
+
+// startLocal starts socksLocal, udpSocksLocal, mixedLocal and httpLocal with
+// a shadowsocks server behind them, once for all tests as they never stop.
+func startLocal(t *testing.T) localProxies {
+	o := &localOnce
+	o.Do(func() {
+		ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "test")
+		if err != nil {
+			o.err = err
+			return
+		}
+		if config.Resolver, o.err = newResolver("", "", 0); o.err != nil {
+			return
+		}
+		config.UDPSocks = true
+		config.UDPTimeout = time.Minute
+		handshakeTimeout = testHandshakeTimeout
+
+		server := freeAddr(t)
+		p := localProxies{freeAddr(t), freeAddr(t), freeAddr(t)}
+		go tcpRemote(server, ciph.StreamConn)
+		go udpRemote(server, ciph.PacketConn)
+		go socksLocal(p.socks, server, ciph.StreamConn)
+		go udpSocksLocal(p.socks, server, ciph.PacketConn)
+		go mixedLocal(p.mixed, server, ciph.StreamConn)
+		go httpLocal(p.http, server, ciph.StreamConn)
+		for _, addr := range []string{server, p.socks, p.mixed, p.http} {
+			waitListening(t, addr)
+		}
+		o.addrs = p
+	})
+	if o.err != nil {
+		t.Fatal(o.err)
+	}
+	return o.addrs
+}
+
+// TestSocksLocal drives socksLocal and udpSocksLocal with socks.Dialer through
+// a shadowsocks server to echo servers.
+func TestSocksLocal(t *testing.T) {
+	d := &socks.Dialer{ProxyAddress: startLocal(t).socks}
+
+	t.Run("CONNECT", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := d.DialContext(ctx, "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+			t.Errorf("echoed %q, %v", got, err)
+		}
+	})
+
+	t.Run("UDP ASSOCIATE", func(t *testing.T) {
+		echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer echo.Close()
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, addr, err := echo.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				echo.WriteTo(buf[:n], addr)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		pc, err := d.ListenPacket(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		pc.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, msg := range []string{"one", "two"} {
+			if _, err := pc.WriteTo([]byte(msg), echo.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1500)
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], []byte(msg)) || addr.String() != echo.LocalAddr().String() {
+				t.Errorf("got %q from %s, want %q from %s", buf[:n], addr, msg, echo.LocalAddr())
+			}
+		}
+	})
+}
+
+// TestHandshakeTimeout checks that clients stalling in the handshake are
+// dropped, however far they got.
+func TestHandshakeTimeout(t *testing.T) {
+	p := startLocal(t)
+	tests := []struct {
+		name, addr, sent string
+	}{
+		{"SOCKS silent", p.socks, ""},
+		{"SOCKS5 methods only", p.socks, "\x05\x01\x00"},
+		{"SOCKS4 partial request", p.socks, "\x04\x01\x00\x50"},
+		{"mixed silent", p.mixed, ""},
+		{"mixed SOCKS4 partial request", p.mixed, "\x04\x01\x00\x50\x01\x02\x03\x04user"},
+		{"mixed HTTP partial request", p.mixed, "CONNECT example.com:443 HTTP/1.1\r\n"},
+		{"HTTP silent", p.http, ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c, err := net.Dial("tcp", tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Write([]byte(tt.sent))
+			c.SetReadDeadline(time.Now().Add(testHandshakeTimeout + 2*time.Second))
+			_, err = io.Copy(ioutil.Discard, c)
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				t.Error("connection still open after the handshake timeout")
+			}
+		})
+	}
+}
+
+// TestUserLimitRefused checks that handshakes refuse users over their limit
+// instead of telling them they succeeded.
+func TestUserLimitRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		h     handshake
+		req   string
+		reply string
+	}{
+		{"SOCKS5", socks5Handshake, "\x05\x01\x00\x05\x01\x00\x01\x01\x02\x03\x04\x00\x50", "\x05\x00\x05\x02\x00\x01\x00\x00\x00\x00\x00\x00"},
+		{"SOCKS4", socks4Handshake, "\x04\x01\x00\x50\x01\x02\x03\x04\x00", "\x00\x5b\x00\x00\x00\x00\x00\x00"},
+		{"HTTP CONNECT", httpHandshake, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "HTTP/1.1 503 "},
+		{"HTTP", httpHandshake, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 503 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, peer := net.Pipe()
+			defer peer.Close()
+			go peer.Write([]byte(tt.req))
+			go func() {
+				defer c.Close()
+				sess := newSession("tcp", nil)
+				sess.admit = func() bool { return false }
+				if _, _, err := tt.h(c, sess); err != errUserLimit {
+					t.Errorf("handshake: %v, want %v", err, errUserLimit)
+				}
+			}()
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := ioutil.ReadAll(peer)
+			if err != nil || !strings.HasPrefix(string(got), tt.reply) {
+				t.Errorf("replied %q, %v; want %q", got, err, tt.reply)
+			}
+		})
+	}
+}
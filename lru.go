@@ -0,0 +1,51 @@
+package main
+
+import "container/list"
+
+// lruCache maps keys to values, dropping the least recently used ones beyond
+// its size. It is not safe for concurrent use.
+type lruCache struct {
+	size int
+	m    map[string]*list.Element
+	lru  list.List // of *lruEntry, most recently used first
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, m: make(map[string]*list.Element)}
+}
+
+// Get returns the value under key, if any, marking it used.
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	e, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// Put stores value under key.
+func (c *lruCache) Put(key string, value interface{}) {
+	if e, ok := c.m[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.lru.MoveToFront(e)
+		return
+	}
+	for len(c.m) >= c.size {
+		c.Del(c.lru.Back().Value.(*lruEntry).key)
+	}
+	c.m[key] = c.lru.PushFront(&lruEntry{key, value})
+}
+
+// Del removes the value under key, if any.
+func (c *lruCache) Del(key string) {
+	if e, ok := c.m[key]; ok {
+		c.lru.Remove(e)
+		delete(c.m, key)
+	}
+}
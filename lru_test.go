@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Get("a") // b is now the least recently used
+	c.Put("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Error("b not evicted")
+	}
+	for k, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.Get(k); !ok || v.(int) != want {
+			t.Errorf("Get(%q) = %v, %v; want %d", k, v, ok, want)
+		}
+	}
+
+	c.Put("a", 4) // replaces without evicting
+	if v, _ := c.Get("a"); v.(int) != 4 || len(c.m) != 2 {
+		t.Errorf("after replacing a: %v, %d entries", v, len(c.m))
+	}
+	c.Del("a")
+	if _, ok := c.Get("a"); ok || c.lru.Len() != 1 {
+		t.Errorf("a not deleted")
+	}
+}
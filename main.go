@@ -19,8 +19,23 @@ import (
 )
 
 var config struct {
-	Verbose    bool
-	UDPTimeout time.Duration
+	Verbose     bool
+	UDPTimeout  time.Duration
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	TCPFastOpen bool
+	Bind        bool
+	UDPSocks    bool
+	DeferReply  string // when to send SOCKS5 CONNECT replies: immediately if empty, deferToServer or deferToTarget
+	RateLimit   *rateLimiter
+	ConnLimit   *connLimiter
+	Credentials socks.Credentials // required of local proxy clients if not nil
+	Routes      *router           // upstreams by local proxy user
+	Outbounds   *outbounds        // how the server reaches targets
+	Resolver    *resolver         // how the server looks up targets
+	Via         *core.Dialer      // servers the client goes through to reach its server
+	FakeIP      *fakeIPPool       // fake IPs handed out by the DNS forwarder, translated back by redirects
+	Sniff       bool              // replace IP targets of transparent and SOCKS clients by sniffed domains
 }
 
 func logf(f string, v ...interface{}) {
@@ -32,18 +47,40 @@ func logf(f string, v ...interface{}) {
 func main() {
 
 	var flags struct {
-		Client    string
-		Server    string
-		Cipher    string
-		Key       string
-		Password  string
-		Keygen    int
-		Socks     string
-		RedirTCP  string
-		RedirTCP6 string
-		TCPTun    string
-		UDPTun    string
-		UDPSocks  bool
+		Client          string
+		Server          string
+		Cipher          string
+		Key             string
+		Password        string
+		Keygen          int
+		Socks           string
+		HTTP            string
+		Mixed           string
+		AuthUsers       string
+		AuthFile        string
+		Routes          string
+		Outbound        string
+		Resolver        string
+		Hosts           string
+		DualStack       string
+		RaceDelay       time.Duration
+		Via             string
+		DNS             string
+		DNSUpstream     string
+		DNSTCP          bool
+		DNSDirect       string
+		DNSDirectServer string
+		DNSFakeIP       string
+		RedirTCP        string
+		RedirTCP6       string
+		TProxy          string
+		TCPTun          string
+		UDPTun          string
+		AccessLog       string
+		RateLimit       string
+		MaxConns        int
+		MaxConnsPerIP   int
+		MaxConnsPerUser int
 	}
 
 	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode")
@@ -53,13 +90,42 @@ func main() {
 	flag.StringVar(&flags.Password, "password", "", "password")
 	flag.StringVar(&flags.Server, "s", "", "server listen address or url")
 	flag.StringVar(&flags.Client, "c", "", "client connect address or url")
+	flag.StringVar(&flags.Via, "via", "", "(client-only) reach the server through these shadowsocks servers (ss://URL1,ss://URL2,...) in order")
 	flag.StringVar(&flags.Socks, "socks", "", "(client-only) SOCKS listen address")
-	flag.BoolVar(&flags.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS")
+	flag.StringVar(&flags.HTTP, "http", "", "(client-only) HTTP proxy listen address")
+	flag.StringVar(&flags.Mixed, "mixed", "", "(client-only) SOCKS5, SOCKS4/4a and HTTP proxy listen address")
+	flag.StringVar(&flags.AuthUsers, "authusers", "", "(client-only) require SOCKS5/HTTP proxy clients to log in as one of user1:pass1,user2:pass2,...")
+	flag.StringVar(&flags.AuthFile, "authfile", "", "(client-only) require SOCKS5/HTTP proxy clients to log in as a user of this htpasswd file, reloaded on SIGHUP")
+	flag.StringVar(&flags.Routes, "routes", "", "(client-only) file of 'user ss://URL' lines routing authenticated proxy users to their own upstream, reloaded on SIGHUP")
+	flag.StringVar(&flags.Outbound, "outbound", "", "(server-only) file of 'match URL' lines sending matching targets through SOCKS5, HTTP or shadowsocks upstreams, reloaded on SIGHUP")
+	flag.StringVar(&flags.Resolver, "resolver", "", "(server-only) DNS servers to look up targets with instead of the system resolver (udp://addr,tcp://addr,tls://addr,...)")
+	flag.StringVar(&flags.Hosts, "hosts", "", "(server-only) file of 'IP host...' lines overriding target lookups, reloaded on SIGHUP")
+	flag.StringVar(&flags.DualStack, "dualstack", "", "(server-only) how to connect to targets with IPv4 and IPv6 addresses: ipv4-only, ipv6-only, prefer-ipv4, prefer-ipv6 or race")
+	flag.DurationVar(&flags.RaceDelay, "racedelay", 250*time.Millisecond, "(server-only) delay between connection attempts with -dualstack race")
+	flag.BoolVar(&config.Bind, "bind", false, "Enable SOCKS BIND (client), and accept BIND requests (server)")
+	flag.StringVar(&config.DeferReply, "deferreply", "", "(client-only) delay SOCKS5 CONNECT replies until connected to the server (server) or until the server connected to the target (target) to report failures")
+	flag.BoolVar(&config.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS")
+	flag.StringVar(&flags.DNS, "dns", "", "(client-only) DNS server listen address (UDP and TCP), resolving through the server")
+	flag.StringVar(&flags.DNSUpstream, "dnsupstream", "8.8.8.8:53", "(client-only) upstream resolvers for -dns, reached through the server (addr1,addr2,...)")
+	flag.BoolVar(&flags.DNSTCP, "dnstcp", false, "(client-only) query -dns upstreams over TCP instead of UDP")
+	flag.StringVar(&flags.DNSDirect, "dnsdirect", "", "(client-only) file of domains -dns resolves with -dnsdirectserver instead, reloaded on SIGHUP")
+	flag.StringVar(&flags.DNSDirectServer, "dnsdirectserver", "", "(client-only) resolver address for -dnsdirect domains, reached directly")
+	flag.StringVar(&flags.DNSFakeIP, "dnsfakeip", "", "(client-only) answer -dns address queries with fake IPs from this range (e.g. 198.18.0.0/15) that -redir and -tproxy map back to domains")
+	flag.BoolVar(&config.Sniff, "sniff", false, "(client-only) send -redir, -tproxy and SOCKS connections to IP addresses to the domain found in their TLS, HTTP or QUIC traffic instead")
 	flag.StringVar(&flags.RedirTCP, "redir", "", "(client-only) redirect TCP from this address")
 	flag.StringVar(&flags.RedirTCP6, "redir6", "", "(client-only) redirect TCP IPv6 from this address")
+	flag.StringVar(&flags.TProxy, "tproxy", "", "(client-only) TPROXY transparent proxy for TCP and UDP on this address (Linux only)")
 	flag.StringVar(&flags.TCPTun, "tcptun", "", "(client-only) TCP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
 	flag.StringVar(&flags.UDPTun, "udptun", "", "(client-only) UDP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
 	flag.DurationVar(&config.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
+	flag.DurationVar(&config.IdleTimeout, "idletimeout", 0, "close TCP relays idle in both directions for this long (0 to disable)")
+	flag.DurationVar(&config.MaxLifetime, "maxlifetime", 0, "close TCP relays alive for this long (0 to disable)")
+	flag.StringVar(&flags.AccessLog, "accesslog", "", "write a record per finished session to this file (- for stdout)")
+	flag.StringVar(&flags.RateLimit, "ratelimit", "", "bandwidth limits file, reloaded on SIGHUP")
+	flag.IntVar(&flags.MaxConns, "maxconns", 0, "maximum number of concurrent TCP connections (0 for unlimited)")
+	flag.IntVar(&flags.MaxConnsPerIP, "maxconnsperip", 0, "maximum number of concurrent TCP connections per client IP (0 for unlimited)")
+	flag.IntVar(&flags.MaxConnsPerUser, "maxconnsperuser", 0, "maximum number of concurrent TCP connections per user or listen address (0 for unlimited)")
+	flag.BoolVar(&config.TCPFastOpen, "tfo", false, "use TCP Fast Open to connect to and listen as server (Linux only)")
 	flag.Parse()
 
 	if flags.Keygen > 0 {
@@ -74,6 +140,76 @@ func main() {
 		return
 	}
 
+	if flags.AccessLog != "" {
+		if err := openAccessLog(flags.AccessLog); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var reloaders []func() error // called on SIGHUP
+
+	if flags.RateLimit != "" {
+		rl := newRateLimiter()
+		if err := rl.Load(flags.RateLimit); err != nil {
+			log.Fatal(err)
+		}
+		config.RateLimit = rl
+		reloaders = append(reloaders, func() error { return rl.Load(flags.RateLimit) })
+	}
+
+	switch {
+	case flags.AuthUsers != "" && flags.AuthFile != "":
+		log.Fatal("-authusers and -authfile are mutually exclusive")
+	case flags.AuthUsers != "":
+		creds, err := parseUserList(flags.AuthUsers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Credentials = creds
+	case flags.AuthFile != "":
+		h, err := newHtpasswd(flags.AuthFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Credentials = h
+		reloaders = append(reloaders, h.Load)
+	}
+
+	if flags.MaxConns > 0 || flags.MaxConnsPerIP > 0 || flags.MaxConnsPerUser > 0 {
+		config.ConnLimit = newConnLimiter(flags.MaxConns, flags.MaxConnsPerIP, flags.MaxConnsPerUser)
+	}
+
+	if flags.Routes != "" {
+		r, err := newRouter(flags.Routes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Routes = r
+		reloaders = append(reloaders, r.Load)
+	}
+
+	if flags.Outbound != "" {
+		o, err := newOutbounds(flags.Outbound)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Outbounds = o
+		reloaders = append(reloaders, o.Load)
+	}
+
+	r, err := newResolver(flags.Resolver, flags.DualStack, flags.RaceDelay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flags.Hosts != "" {
+		r.hosts, err = newHostsFile(flags.Hosts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, r.hosts.Load)
+	}
+	config.Resolver = r
+
 	var key []byte
 	if flags.Key != "" {
 		k, err := base64.URLEncoding.DecodeString(flags.Key)
@@ -101,6 +237,13 @@ func main() {
 			log.Fatal(err)
 		}
 
+		if flags.Via != "" {
+			config.Via, err = parseVia(flags.Via)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		if flags.UDPTun != "" {
 			for _, tun := range strings.Split(flags.UDPTun, ",") {
 				p := strings.Split(tun, "=")
@@ -115,14 +258,60 @@ func main() {
 			}
 		}
 
+		switch config.DeferReply {
+		case "", deferToServer, deferToTarget:
+		default:
+			log.Fatalf("invalid -deferreply %q", config.DeferReply)
+		}
+
 		if flags.Socks != "" {
-			socks.UDPEnabled = flags.UDPSocks
 			go socksLocal(flags.Socks, addr, ciph.StreamConn)
-			if flags.UDPSocks {
+			if config.UDPSocks {
 				go udpSocksLocal(flags.Socks, addr, ciph.PacketConn)
 			}
 		}
 
+		if flags.HTTP != "" {
+			go httpLocal(flags.HTTP, addr, ciph.StreamConn)
+		}
+
+		if flags.Mixed != "" {
+			go mixedLocal(flags.Mixed, addr, ciph.StreamConn)
+			if config.UDPSocks {
+				go udpSocksLocal(flags.Mixed, addr, ciph.PacketConn)
+			}
+		}
+
+		if flags.DNS != "" {
+			f := &dnsForwarder{
+				server:       addr,
+				shadow:       ciph.StreamConn,
+				shadowPacket: ciph.PacketConn,
+				upstreams:    strings.Split(flags.DNSUpstream, ","),
+				tcp:          flags.DNSTCP,
+				cache:        newDNSCache(),
+			}
+			if flags.DNSDirect != "" {
+				if flags.DNSDirectServer == "" {
+					log.Fatal("-dnsdirect needs -dnsdirectserver")
+				}
+				f.direct, err = newDomainSet(flags.DNSDirect)
+				if err != nil {
+					log.Fatal(err)
+				}
+				f.directResolver = flags.DNSDirectServer
+				reloaders = append(reloaders, f.direct.Load)
+			}
+			if flags.DNSFakeIP != "" {
+				config.FakeIP, err = newFakeIPPool(flags.DNSFakeIP)
+				if err != nil {
+					log.Fatal(err)
+				}
+				f.fakeIP = config.FakeIP
+			}
+			go dnsLocal(flags.DNS, f)
+		}
+
 		if flags.RedirTCP != "" {
 			go redirLocal(flags.RedirTCP, addr, ciph.StreamConn)
 		}
@@ -130,6 +319,11 @@ func main() {
 		if flags.RedirTCP6 != "" {
 			go redir6Local(flags.RedirTCP6, addr, ciph.StreamConn)
 		}
+
+		if flags.TProxy != "" {
+			go tproxyLocal(flags.TProxy, addr, ciph.StreamConn)
+			go udpTproxyLocal(flags.TProxy, addr, ciph.PacketConn)
+		}
 	}
 
 	if flags.Server != "" { // server mode
@@ -155,8 +349,17 @@ func main() {
 	}
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		for _, reload := range reloaders {
+			if err := reload(); err != nil {
+				log.Printf("failed to reload: %v", err)
+			}
+		}
+	}
 }
 
 func parseURL(s string) (addr, cipher, password string, err error) {
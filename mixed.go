@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Create a proxy server listening on addr accepting SOCKS5, SOCKS4/4a and
+// HTTP proxy clients alike, and proxy to server.
+func mixedLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+	logf("mixed SOCKS/HTTP proxy %s <-> %s", addr, server)
+	tcpLocal(addr, server, shadow, sniffing(mixedHandshake), refuseMixed)
+}
+
+// peekVersion peeks the first byte from c to tell the protocol apart. Returns
+// the byte and a connection replaying it.
+func peekVersion(c net.Conn) (byte, net.Conn, error) {
+	br := bufio.NewReader(c)
+	b, err := br.Peek(1)
+	if err != nil {
+		return 0, nil, err
+	}
+	return b[0], &readerConn{Conn: c, r: br}, nil
+}
+
+// mixedHandshake dispatches to the SOCKS5, SOCKS4 or HTTP handshake based on
+// the first byte sent by the client.
+func mixedHandshake(c net.Conn, sess *session) (net.Conn, socks.Addr, error) {
+	ver, c, err := peekVersion(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch ver {
+	case 5:
+		return socks5Handshake(c, sess)
+	case 4:
+		return socks4Handshake(c, sess)
+	}
+	return httpHandshake(c, sess)
+}
+
+// Tell a client of any protocol that it is over the connection limits.
+func refuseMixed(c net.Conn) {
+	ver, c, err := peekVersion(c)
+	if err != nil {
+		return
+	}
+	switch ver {
+	case 5:
+		socks.Refuse(c, socks.ErrConnectionNotAllowed)
+	case 4:
+		socks.Refuse4(c)
+	default:
+		refuseHTTP(c)
+	}
+}
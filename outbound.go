@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// outbound is how the server reaches targets.
+type outbound interface {
+	// Dial connects to tgt over TCP.
+	Dial(tgt socks.Addr) (net.Conn, error)
+	// ListenPacket returns a socket sending datagrams to and receiving them
+	// from targets. Targets may be any net.Addr whose String is a host:port,
+	// resolved on the way out unless direct.
+	ListenPacket() (net.PacketConn, error)
+	String() string
+}
+
+// upstreamTimeout bounds the handshake with an upstream proxy.
+const upstreamTimeout = 30 * time.Second
+
+// directOutbound reaches targets from the server itself.
+type directOutbound struct{}
+
+func (directOutbound) ListenPacket() (net.PacketConn, error) { return net.ListenPacket("udp", "") }
+func (directOutbound) String() string                        { return "direct" }
+
+// Dial connects to tgt with the addresses of config.Resolver.
+func (directOutbound) Dial(tgt socks.Addr) (net.Conn, error) {
+	return config.Resolver.Dial(tgt.String())
+}
+
+// socksOutbound reaches targets through a SOCKS5 proxy.
+type socksOutbound struct {
+	socks.Dialer
+}
+
+func (o *socksOutbound) Dial(tgt socks.Addr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	return o.DialContext(ctx, "tcp", tgt.String())
+}
+
+func (o *socksOutbound) ListenPacket() (net.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	return o.Dialer.ListenPacket(ctx)
+}
+
+func (o *socksOutbound) String() string { return "socks5://" + o.ProxyAddress }
+
+// httpOutbound reaches targets through an HTTP proxy supporting CONNECT.
+type httpOutbound struct {
+	addr string
+	auth string // Proxy-Authorization header value, if any
+}
+
+func (o *httpOutbound) Dial(tgt socks.Addr) (net.Conn, error) {
+	c, err := net.Dial("tcp", o.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(upstreamTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: tgt.String()},
+		Host:   tgt.String(),
+		Header: make(http.Header),
+	}
+	if o.auth != "" {
+		req.Header.Set("Proxy-Authorization", o.auth)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %s", o.addr, resp.Status)
+	}
+	c.SetDeadline(time.Time{})
+	return &readerConn{Conn: c, r: br}, nil // the target may have sent data already
+}
+
+func (o *httpOutbound) ListenPacket() (net.PacketConn, error) {
+	return nil, errors.New("HTTP proxies cannot relay UDP")
+}
+
+func (o *httpOutbound) String() string { return "http://" + o.addr }
+
+// ssOutbound reaches targets through another shadowsocks server.
+type ssOutbound struct {
+	core.Dialer // with a single hop
+}
+
+func (o *ssOutbound) Dial(tgt socks.Addr) (net.Conn, error) {
+	return o.Dialer.Dial("tcp", tgt.String())
+}
+
+func (o *ssOutbound) ListenPacket() (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	tpc, err := o.PacketConn(pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return tpc, nil
+}
+
+func (o *ssOutbound) String() string { return "ss://" + o.Hops[0].Server }
+
+// parseOutbound parses an upstream URL: direct, socks5://[user:pass@]host:port,
+// http://[user:pass@]host:port or ss://cipher:password@host:port.
+func parseOutbound(s string) (outbound, error) {
+	if s == "direct" {
+		return directOutbound{}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", s)
+	}
+	switch u.Scheme {
+	case "socks5":
+		o := &socksOutbound{socks.Dialer{ProxyAddress: u.Host}}
+		if u.User != nil {
+			o.Username = u.User.Username()
+			o.Password, _ = u.User.Password()
+		}
+		return o, nil
+	case "http":
+		o := &httpOutbound{addr: u.Host}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			o.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		}
+		return o, nil
+	case "ss":
+		addr, cipher, password, err := parseURL(s)
+		if err != nil {
+			return nil, err
+		}
+		ciph, err := core.PickCipher(cipher, nil, password)
+		if err != nil {
+			return nil, err
+		}
+		return &ssOutbound{core.Dialer{Hops: []core.Hop{{Server: addr, Cipher: ciph}}, Forward: dialNetwork}}, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream %q", s)
+}
+
+// outboundRule sends targets matching it through an outbound.
+type outboundRule struct {
+	user   string     // limitKey of the session, if not empty
+	domain string     // domain name suffix, if not empty
+	cidr   *net.IPNet // IP range, if not nil
+	port   int        // port, if not zero
+	out    outbound
+}
+
+func (r *outboundRule) Match(user string, tgt socks.Addr) bool {
+	host, port, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return false
+	}
+	switch {
+	case r.user != "":
+		return r.user == user
+	case r.domain != "":
+		host = strings.ToLower(host)
+		return tgt[0] == socks.AtypDomainName && (host == r.domain || strings.HasSuffix(host, "."+r.domain))
+	case r.cidr != nil:
+		ip := net.ParseIP(host)
+		return tgt[0] != socks.AtypDomainName && ip != nil && r.cidr.Contains(ip)
+	case r.port != 0:
+		return port == strconv.Itoa(r.port)
+	}
+	return true
+}
+
+// outbounds selects how the server reaches a target by the first matching
+// rule, going direct if none matches. A nil *outbounds always goes direct.
+type outbounds struct {
+	sync.RWMutex
+	path  string
+	rules []outboundRule
+}
+
+func newOutbounds(path string) (*outbounds, error) {
+	o := &outbounds{path: path}
+	return o, o.Load()
+}
+
+// Load (re)reads the outbound rules file. Each line holds a match, one of
+// user:NAME, domain:SUFFIX, cidr:PREFIX, port:N or *, and an upstream URL.
+func (o *outbounds) Load() error {
+	f, err := os.Open(o.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rules []outboundRule
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expecting match and upstream URL", o.path, line)
+		}
+		var r outboundRule
+		kind, value := fields[0], ""
+		if i := strings.IndexByte(kind, ':'); i >= 0 {
+			kind, value = kind[:i], kind[i+1:]
+		}
+		switch kind {
+		case "*":
+		case "user":
+			r.user = value
+		case "domain":
+			r.domain = strings.TrimSuffix(strings.ToLower(value), ".")
+		case "cidr":
+			_, r.cidr, err = net.ParseCIDR(value)
+		case "port":
+			r.port, err = strconv.Atoi(value)
+			if err == nil && (r.port <= 0 || r.port > 65535) {
+				err = fmt.Errorf("invalid port %d", r.port)
+			}
+		default:
+			err = fmt.Errorf("unknown match %q", fields[0])
+		}
+		if err == nil && kind != "*" && value == "" {
+			err = fmt.Errorf("empty match %q", fields[0])
+		}
+		if err == nil {
+			r.out, err = parseOutbound(fields[1])
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", o.path, line, err)
+		}
+		rules = append(rules, r)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	o.Lock()
+	o.rules = rules
+	o.Unlock()
+	return nil
+}
+
+// Select returns the outbound for a session accounted to user going to tgt.
+func (o *outbounds) Select(user string, tgt socks.Addr) outbound {
+	if o == nil {
+		return directOutbound{}
+	}
+	o.RLock()
+	defer o.RUnlock()
+	for i := range o.rules {
+		if o.rules[i].Match(user, tgt) {
+			return o.rules[i].out
+		}
+	}
+	return directOutbound{}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/netutil"
+)
+
+// Directions of relayed data as seen from the client.
+const (
+	dirUp   = 0 // client to target
+	dirDown = 1 // target to client
+)
+
+// minBurst is the smallest bucket size so that a full UDP datagram always fits.
+const minBurst = udpBufSize
+
+// bucket is a token bucket refilled at rate bytes per second. A zero rate means unlimited.
+type bucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64) *bucket {
+	b := &bucket{rate: rate, last: time.Now()}
+	b.tokens = b.burst()
+	return b
+}
+
+func (b *bucket) burst() float64 {
+	if b.rate < minBurst {
+		return minBurst
+	}
+	return b.rate
+}
+
+func (b *bucket) setRate(rate float64) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	b.rate = rate
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+// refill must be called with b locked.
+func (b *bucket) refill() {
+	now := time.Now()
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst() {
+			b.tokens = b.burst()
+		}
+	}
+	b.last = now
+}
+
+// take consumes n tokens, going into debt if needed, and returns how long the
+// caller should wait before the debt is paid off.
+func (b *bucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter holds global, per-user and per-connection bandwidth limits.
+// Limits can be replaced at runtime with Load; live buckets pick up new rates.
+type rateLimiter struct {
+	sync.Mutex
+	global   [2]*bucket
+	connRate [2]float64
+	userRate map[string][2]float64 // by user name or listen address
+	defRate  [2]float64            // for users not in userRate
+	users    map[string]*[2]*bucket
+	conns    map[*flow]struct{}
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		global:   [2]*bucket{newBucket(0), newBucket(0)},
+		userRate: make(map[string][2]float64),
+		users:    make(map[string]*[2]*bucket),
+		conns:    make(map[*flow]struct{}),
+	}
+}
+
+// Load reads limits from the file at path and applies them to live buckets.
+//
+// Each line is one of the following, with rates in bytes per second
+// (K, M and G suffixes allowed; 0 means unlimited):
+//
+//	global <up> <down>
+//	conn <up> <down>
+//	user <name or listen address> <up> <down>
+//	user * <up> <down>
+func (rl *rateLimiter) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var global, conn, def [2]float64
+	users := make(map[string][2]float64)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var name string
+		switch {
+		case fields[0] == "user" && len(fields) == 4:
+			name, fields = fields[1], fields[2:]
+		case (fields[0] == "global" || fields[0] == "conn") && len(fields) == 3:
+			name, fields = fields[0], fields[1:]
+		default:
+			return fmt.Errorf("%s:%d: malformed rate limit", path, line)
+		}
+		var r [2]float64
+		for i := range r {
+			if r[i], err = parseRate(fields[i]); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		}
+		switch name {
+		case "global":
+			global = r
+		case "conn":
+			conn = r
+		case "*":
+			def = r
+		default:
+			users[name] = r
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+	rl.connRate, rl.userRate, rl.defRate = conn, users, def
+	for i := range global {
+		rl.global[i].setRate(global[i])
+	}
+	for name, b := range rl.users {
+		r := rl.rateOf(name)
+		b[dirUp].setRate(r[dirUp])
+		b[dirDown].setRate(r[dirDown])
+	}
+	for f := range rl.conns {
+		f.conn[dirUp].setRate(conn[dirUp])
+		f.conn[dirDown].setRate(conn[dirDown])
+	}
+	return nil
+}
+
+// parseRate parses a byte rate such as 512K or 10M.
+func parseRate(s string) (float64, error) {
+	mul := 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mul = 1 << 10
+	case "M":
+		mul = 1 << 20
+	case "G":
+		mul = 1 << 30
+	}
+	if mul != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return v * mul, nil
+}
+
+// rateOf must be called with rl locked.
+func (rl *rateLimiter) rateOf(user string) [2]float64 {
+	if r, ok := rl.userRate[user]; ok {
+		return r
+	}
+	return rl.defRate
+}
+
+// Flow returns the set of buckets a new session of user is subject to. The
+// user is the name the session is accounted to, or the listen address if none.
+// Close the flow when the session ends.
+func (rl *rateLimiter) Flow(user string) *flow {
+	rl.Lock()
+	defer rl.Unlock()
+
+	u, ok := rl.users[user]
+	if !ok {
+		r := rl.rateOf(user)
+		u = &[2]*bucket{newBucket(r[dirUp]), newBucket(r[dirDown])}
+		rl.users[user] = u
+	}
+	f := &flow{rl: rl}
+	for i := range f.conn {
+		f.conn[i] = newBucket(rl.connRate[i])
+		f.buckets[i] = []*bucket{rl.global[i], u[i], f.conn[i]}
+	}
+	rl.conns[f] = struct{}{}
+	return f
+}
+
+// limitKey is the name a session is accounted to for per-user limits: the
+// user if known, otherwise the address it was accepted on.
+func limitKey(user, laddr string) string {
+	if user != "" {
+		return user
+	}
+	return laddr
+}
+
+// flow throttles the data of a single session.
+type flow struct {
+	rl      *rateLimiter
+	conn    [2]*bucket
+	buckets [2][]*bucket
+}
+
+// Close stops tracking f for runtime limit updates.
+func (f *flow) Close() {
+	f.rl.Lock()
+	defer f.rl.Unlock()
+	delete(f.rl.conns, f)
+}
+
+// Wait blocks until n bytes in direction dir conform to all limits.
+func (f *flow) Wait(dir, n int) {
+	var d time.Duration
+	for _, b := range f.buckets[dir] {
+		if t := b.take(n); t > d {
+			d = t
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Allow reports whether a datagram of n bytes in direction dir conforms to
+// all limits, and consumes the tokens if so. The buckets are locked together,
+// always in the order global, user, conn, so that flows sharing some of them
+// neither overdraw them nor deadlock.
+func (f *flow) Allow(dir, n int) bool {
+	bs := f.buckets[dir]
+	for _, b := range bs {
+		b.Lock()
+		defer b.Unlock()
+	}
+	for _, b := range bs {
+		if b.rate > 0 {
+			b.refill()
+			if b.tokens < float64(n) {
+				return false
+			}
+		}
+	}
+	for _, b := range bs {
+		if b.rate > 0 {
+			b.tokens -= float64(n)
+		}
+	}
+	return true
+}
+
+// limitedConn throttles data read from the embedded net.Conn.
+type limitedConn struct {
+	net.Conn
+	f   *flow
+	dir int
+}
+
+func (c *limitedConn) CloseWrite() error { return netutil.CloseWrite(c.Conn) }
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.f.Wait(c.dir, n)
+	}
+	return n, err
+}
+
+// limitedPacketConn polices datagrams of a NAT session: packets over the limit are dropped.
+// Closing it closes the flow.
+type limitedPacketConn struct {
+	net.PacketConn
+	f *flow
+}
+
+func (c *limitedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !c.f.Allow(dirUp, len(b)) {
+		return len(b), nil // drop silently like a congested link would
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *limitedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || c.f.Allow(dirDown, n) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *limitedPacketConn) Close() error {
+	c.f.Close()
+	return c.PacketConn.Close()
+}
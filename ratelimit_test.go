@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucketBurst(t *testing.T) {
+	for _, rate := range []float64{1000, 1 << 20} {
+		b := newBucket(rate)
+		burst := b.burst()
+		if burst < minBurst || burst < rate {
+			t.Errorf("rate %v: burst %v", rate, burst)
+		}
+		if d := b.take(int(burst)); d != 0 {
+			t.Errorf("rate %v: full bucket waits %v", rate, d)
+		}
+		// a second's worth of debt takes a second to pay off
+		if d := b.take(int(rate)); d < 990*time.Millisecond || d > time.Second {
+			t.Errorf("rate %v: waits %v for a second's worth", rate, d)
+		}
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	const rate = 1 << 20
+	b := newBucket(rate)
+	b.take(int(b.burst()))
+	b.last = b.last.Add(-500 * time.Millisecond)
+	b.Lock()
+	b.refill()
+	tokens := b.tokens
+	b.Unlock()
+	if tokens < rate/2 || tokens > rate/2+rate/50 {
+		t.Errorf("%v tokens after half a second, want %v", tokens, rate/2)
+	}
+
+	b.last = b.last.Add(-time.Hour)
+	b.Lock()
+	b.refill()
+	tokens = b.tokens
+	b.Unlock()
+	if tokens != b.burst() {
+		t.Errorf("%v tokens after an hour, want the burst %v", tokens, b.burst())
+	}
+}
+
+func TestFlowAllow(t *testing.T) {
+	rl := newRateLimiter()
+	rl.connRate = [2]float64{1 << 20, 0}
+	f := rl.Flow("alice")
+	defer f.Close()
+	if !f.Allow(dirUp, 1<<20) {
+		t.Fatal("burst refused")
+	}
+	if f.Allow(dirUp, 1000) {
+		t.Error("datagram over the limit allowed")
+	}
+	if !f.Allow(dirDown, 1<<20) {
+		t.Error("unlimited direction refused")
+	}
+}
+
+func TestFlowSharedUser(t *testing.T) {
+	const size = 1000
+	rl := newRateLimiter()
+	rl.userRate["alice"] = [2]float64{minBurst, minBurst}
+	flows := []*flow{rl.Flow("alice"), rl.Flow("alice")}
+	other := rl.Flow("bob")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for _, f := range flows {
+		wg.Add(1)
+		go func(f *flow) {
+			defer wg.Done()
+			for i := 0; i < minBurst/size; i++ {
+				if f.Allow(dirUp, size) {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}(f)
+	}
+	wg.Wait()
+	// refilling while the test runs may let a datagram or two more through
+	if max := minBurst/size + 2; allowed < minBurst/size || allowed > max {
+		t.Errorf("%d datagrams allowed to the two flows, want %d to %d", allowed, minBurst/size, max)
+	}
+	if !other.Allow(dirUp, size) {
+		t.Error("flow of another user refused")
+	}
+}
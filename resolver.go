@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dual-stack strategies: which address families of a target to connect to,
+// in which order.
+const (
+	ipv4Only   = "ipv4-only"
+	ipv6Only   = "ipv6-only"
+	preferIPv4 = "prefer-ipv4"
+	preferIPv6 = "prefer-ipv6"
+	raceIPs    = "race" // Happy Eyeballs (RFC 8305)
+)
+
+// systemTTL is how long answers of the system resolver are cached.
+const systemTTL = 60 * time.Second
+
+// resolver looks up target host names for the server, from hosts overrides,
+// its cache or upstream DNS servers. Without upstreams it uses the system
+// resolver.
+type resolver struct {
+	upstreams []dnsUpstream
+	strategy  string
+	raceDelay time.Duration // between connection attempts when racing
+	hosts     *hostsFile
+
+	sync.Mutex
+	cache *lruCache                // of *resolverEntry, by host and family
+	calls map[string]*resolverCall // lookups in flight, by the same key
+}
+
+type resolverEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type resolverCall struct {
+	done chan struct{}
+	resolverEntry
+}
+
+// newResolver returns a resolver querying upstreams, a comma separated list of
+// udp://, tcp:// or tls:// (DNS over TLS) URLs, or UDP host:port addresses.
+func newResolver(upstreams, strategy string, raceDelay time.Duration) (*resolver, error) {
+	r := &resolver{
+		strategy:  strategy,
+		raceDelay: raceDelay,
+		cache:     newLRUCache(dnsCacheSize),
+		calls:     make(map[string]*resolverCall),
+	}
+	switch strategy {
+	case "", ipv4Only, ipv6Only, preferIPv4, preferIPv6, raceIPs:
+	default:
+		return nil, fmt.Errorf("unknown dual-stack strategy %q", strategy)
+	}
+	if upstreams == "" {
+		return r, nil
+	}
+	for _, s := range strings.Split(upstreams, ",") {
+		u := dnsUpstream{network: "udp", addr: s}
+		if strings.Contains(s, "://") {
+			pu, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			u.network, u.addr = pu.Scheme, pu.Host
+		}
+		switch u.network {
+		case "udp", "tcp":
+			if _, _, err := net.SplitHostPort(u.addr); err != nil {
+				u.addr = net.JoinHostPort(u.addr, "53")
+			}
+		case "tls":
+			if _, _, err := net.SplitHostPort(u.addr); err != nil {
+				u.addr = net.JoinHostPort(u.addr, "853")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported DNS upstream %q", s)
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// LookupIP returns the addresses of host in the order of the dual-stack
+// strategy.
+func (r *resolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	answers, n := r.lookupTypes(host)
+	var ips []net.IP
+	var err error
+	for ; n > 0; n-- {
+		a := <-answers
+		ips = append(ips, a.ips...)
+		if err == nil {
+			err = a.err
+		}
+	}
+	if ips = r.order(ips); len(ips) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// resolverAnswer holds the addresses of one type found for a host, or all of
+// them for a hosts override.
+type resolverAnswer struct {
+	qtype uint16
+	ips   []net.IP
+	err   error
+}
+
+// lookupTypes looks up the addresses of each type of host concurrently and
+// returns the channel their n answers arrive on, in no particular order.
+func (r *resolver) lookupTypes(host string) (answers <-chan resolverAnswer, n int) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	types := r.types()
+	c := make(chan resolverAnswer, len(types))
+	if ips, ok := r.hosts.Lookup(host); ok {
+		c <- resolverAnswer{ips: ips}
+		return c, 1
+	}
+	for _, t := range types {
+		go func(t uint16) {
+			ips, err := r.lookup(host, t)
+			c <- resolverAnswer{t, ips, err}
+		}(t)
+	}
+	return c, len(types)
+}
+
+// Cached returns the addresses of host if they are known without a lookup.
+func (r *resolver) Cached(host string) ([]net.IP, bool) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ips, ok := r.hosts.Lookup(host); ok {
+		return r.order(ips), true
+	}
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	var ips []net.IP
+	for _, t := range r.types() {
+		v, ok := r.cache.Get(resolverKey(host, t))
+		if !ok || now.After(v.(*resolverEntry).expires) {
+			return nil, false
+		}
+		ips = append(ips, v.(*resolverEntry).ips...)
+	}
+	if ips = r.order(ips); len(ips) == 0 {
+		return nil, false // to report the error by a lookup
+	}
+	return ips, true
+}
+
+// ResolveUDPAddr resolves the host:port address of a UDP target.
+func (r *resolver) ResolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+}
+
+// types returns the record types to look up for the dual-stack strategy.
+func (r *resolver) types() []uint16 {
+	switch r.strategy {
+	case ipv4Only:
+		return []uint16{dnsTypeA}
+	case ipv6Only:
+		return []uint16{dnsTypeAAAA}
+	}
+	return []uint16{dnsTypeA, dnsTypeAAAA}
+}
+
+// order filters and orders ips for the dual-stack strategy, keeping the order
+// within families. Racing alternates families, starting with IPv6.
+func (r *resolver) order(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch r.strategy {
+	case ipv4Only:
+		return v4
+	case ipv6Only:
+		return v6
+	case preferIPv4:
+		return append(v4, v6...)
+	case preferIPv6:
+		return append(v6, v4...)
+	case raceIPs:
+		var mixed []net.IP
+		for i := 0; i < len(v4) || i < len(v6); i++ {
+			if i < len(v6) {
+				mixed = append(mixed, v6[i])
+			}
+			if i < len(v4) {
+				mixed = append(mixed, v4[i])
+			}
+		}
+		return mixed
+	}
+	return ips
+}
+
+func resolverKey(host string, qtype uint16) string { return fmt.Sprintf("%s/%d", host, qtype) }
+
+// lookup returns the addresses of host of type qtype, from the cache if
+// fresh. Concurrent lookups of the same host share a query.
+func (r *resolver) lookup(host string, qtype uint16) ([]net.IP, error) {
+	key := resolverKey(host, qtype)
+	r.Lock()
+	if v, ok := r.cache.Get(key); ok && time.Now().Before(v.(*resolverEntry).expires) {
+		r.Unlock()
+		return v.(*resolverEntry).ips, v.(*resolverEntry).err
+	}
+	if c, ok := r.calls[key]; ok {
+		r.Unlock()
+		<-c.done
+		return c.ips, c.err
+	}
+	c := &resolverCall{done: make(chan struct{})}
+	r.calls[key] = c
+	r.Unlock()
+
+	var ttl time.Duration
+	if len(r.upstreams) == 0 {
+		c.ips, c.err = lookupSystem(host, qtype)
+		if c.err == nil {
+			ttl = systemTTL
+		}
+	} else {
+		c.ips, ttl, c.err = r.query(host, qtype)
+	}
+
+	r.Lock()
+	delete(r.calls, key)
+	if ttl > 0 {
+		c.expires = time.Now().Add(ttl)
+		r.cache.Put(key, &c.resolverEntry)
+	}
+	r.Unlock()
+	close(c.done)
+	return c.ips, c.err
+}
+
+// lookupSystem looks up the addresses of host of type qtype with the system
+// resolver.
+func lookupSystem(host string, qtype uint16) ([]net.IP, error) {
+	network := "ip4"
+	if qtype == dnsTypeAAAA {
+		network = "ip6"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil // no addresses of this family
+	}
+	return ips, err
+}
+
+// query asks the upstreams in turn for the addresses of host of type qtype.
+// Returns them with how long they may be cached.
+func (r *resolver) query(host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	b, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	q, err := parseDNS(b)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	var resp *dnsMsg
+	var u dnsUpstream
+	for _, u = range r.upstreams {
+		resp, err = dnsExchange(q, u.exchange)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: u.addr, IsTimeout: isTimeout(err)}
+	}
+
+	var ttl time.Duration
+	if min, ok := resp.MinTTL(); ok {
+		ttl = time.Duration(min) * time.Second
+	}
+	if resp.Rcode() == dnsRcodeNXDomain {
+		return nil, ttl, &net.DNSError{Err: "no such host", Name: host, Server: u.addr, IsNotFound: true}
+	}
+	if resp.Rcode() != dnsRcodeSuccess {
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("response code %d", resp.Rcode()), Name: host, Server: u.addr}
+	}
+	var ips []net.IP
+	for _, rr := range resp.Answer {
+		if rr.Type == qtype && (len(rr.Data) == net.IPv4len || len(rr.Data) == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte(nil), rr.Data...)))
+		}
+	}
+	return ips, ttl, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errDNSName means that a name cannot be asked for in a DNS query.
+var errDNSName = errors.New("invalid domain name")
+
+// dnsQuery returns a recursive query for name of type qtype, with an EDNS(0)
+// record for responses over UDP up to 1232 bytes. Names with empty or overlong
+// labels are refused.
+func dnsQuery(name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return nil, errDNSName
+	}
+	b := make([]byte, dnsHeaderLen, dnsHeaderLen+len(name)+2+4+11)
+	rand.Read(b[:2]) // ID
+	b[2] = 0x01      // RD
+	b[5] = 1         // QDCOUNT
+	b[11] = 1        // ARCOUNT
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errDNSName
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return append(b, 0, 0, dnsTypeOPT, 1232>>8, 1232&0xff, 0, 0, 0, 0, 0, 0), nil
+}
+
+// dnsUpstream is a DNS server reached over UDP, TCP or TLS.
+type dnsUpstream struct {
+	network string // udp, tcp or tls
+	addr    string
+}
+
+func (u dnsUpstream) exchange(query []byte) ([]byte, error) {
+	var c net.Conn
+	var err error
+	d := &net.Dialer{Timeout: dnsTimeout}
+	switch u.network {
+	case "udp":
+		return exchangeDirect(query, u.addr)
+	case "tls":
+		c, err = tls.DialWithDialer(d, "tcp", u.addr, nil)
+	default:
+		c, err = d.Dial("tcp", u.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return exchangeStream(c, query)
+}
+
+// hostsFile holds address overrides in the format of /etc/hosts. A nil
+// *hostsFile overrides nothing.
+type hostsFile struct {
+	sync.RWMutex
+	path  string
+	hosts map[string][]net.IP
+}
+
+func newHostsFile(path string) (*hostsFile, error) {
+	h := &hostsFile{path: path}
+	return h, h.Load()
+}
+
+// Load (re)reads the hosts file.
+func (h *hostsFile) Load() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hosts := make(map[string][]net.IP)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expecting an IP address and host names", h.path, line)
+		}
+		for _, name := range fields[1:] {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.hosts = hosts
+	h.Unlock()
+	return nil
+}
+
+// Lookup returns the addresses host is overridden with, if any.
+func (h *hostsFile) Lookup(host string) ([]net.IP, bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.RLock()
+	defer h.RUnlock()
+	ips, ok := h.hosts[host]
+	return ips, ok
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// upstream is a shadowsocks server, and the cipher and key of one of its users.
+type upstream struct {
+	Server string
+	Cipher core.Cipher
+}
+
+// router selects the upstream of a connection by the name the local proxy
+// client authenticated as. A nil *router routes nothing.
+type router struct {
+	sync.RWMutex
+	path   string
+	routes map[string]upstream
+}
+
+func newRouter(path string) (*router, error) {
+	r := &router{path: path}
+	return r, r.Load()
+}
+
+// Load (re)reads the routes file. Each line holds a user name and the
+// ss://cipher:password@host:port URL of the upstream for that user.
+func (r *router) Load() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	routes := make(map[string]upstream)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "ss://") {
+			return fmt.Errorf("%s:%d: expecting user and ss:// URL", r.path, line)
+		}
+		addr, cipher, password, err := parseURL(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", r.path, line, err)
+		}
+		ciph, err := core.PickCipher(cipher, nil, password)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", r.path, line, err)
+		}
+		routes[fields[0]] = upstream{Server: addr, Cipher: ciph}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.routes = routes
+	r.Unlock()
+	return nil
+}
+
+// Lookup returns the upstream for user, if routed.
+func (r *router) Lookup(user string) (upstream, bool) {
+	if r == nil || user == "" {
+		return upstream{}, false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	u, ok := r.routes[user]
+	return u, ok
+}
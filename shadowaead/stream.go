@@ -6,6 +6,8 @@ import (
 	"crypto/rand"
 	"io"
 	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/netutil"
 )
 
 // payloadSizeMask is the maximum size of payload in bytes.
@@ -240,11 +242,7 @@ func (c *streamConn) initWriter() error {
 	if err != nil {
 		return err
 	}
-	_, err = c.Conn.Write(salt)
-	if err != nil {
-		return err
-	}
-	c.w = newWriter(c.Conn, aead)
+	c.w = newWriter(&netutil.PrefixWriter{Writer: c.Conn, Prefix: salt}, aead)
 	return nil
 }
 
@@ -268,3 +266,6 @@ func (c *streamConn) ReadFrom(r io.Reader) (int64, error) {
 
 // NewConn wraps a stream-oriented net.Conn with cipher.
 func NewConn(c net.Conn, ciph Cipher) net.Conn { return &streamConn{Conn: c, Cipher: ciph} }
+
+// CloseWrite shuts down the writing side of the underlying connection, e.g. a *net.TCPConn.
+func (c *streamConn) CloseWrite() error { return netutil.CloseWrite(c.Conn) }
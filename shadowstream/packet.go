@@ -39,8 +39,12 @@ func Unpack(dst, pkt []byte, s Cipher) ([]byte, error) {
 		return nil, io.ErrShortBuffer
 	}
 	iv := pkt[:s.IVSize()]
-	s.Decrypter(iv).XORKeyStream(dst, pkt[len(iv):])
-	return dst[:len(pkt)-len(iv)], nil
+	d := s.Decrypter(iv)
+	// dst and pkt may overlap as when decrypting in place; XORKeyStream only
+	// allows exact overlap, so move the ciphertext into dst first.
+	n := copy(dst, pkt[len(iv):])
+	d.XORKeyStream(dst[:n], dst[:n])
+	return dst[:n], nil
 }
 
 type packetConn struct {
@@ -6,6 +6,8 @@ import (
 	"crypto/rand"
 	"io"
 	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/netutil"
 )
 
 const bufSize = 32 * 1024
@@ -144,10 +146,8 @@ func (c *conn) initWriter() error {
 		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 			return err
 		}
-		if _, err := c.Conn.Write(iv); err != nil {
-			return err
-		}
-		c.w = &writer{Writer: c.Conn, Stream: c.Encrypter(iv), buf: buf}
+		w := &netutil.PrefixWriter{Writer: c.Conn, Prefix: append([]byte(nil), iv...)}
+		c.w = &writer{Writer: w, Stream: c.Encrypter(iv), buf: buf}
 	}
 	return nil
 }
@@ -169,3 +169,6 @@ func (c *conn) ReadFrom(r io.Reader) (int64, error) {
 	}
 	return c.w.ReadFrom(r)
 }
+
+// CloseWrite shuts down the writing side of the underlying connection, e.g. a *net.TCPConn.
+func (c *conn) CloseWrite() error { return netutil.CloseWrite(c.Conn) }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/sniff"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Budget for finding the domain name in what clients send first.
+const (
+	sniffMaxBytes   = 8 * 1024
+	sniffTimeout    = 300 * time.Millisecond // for server-first protocols, which send nothing
+	sniffMaxPackets = 4                      // datagrams held per target while sniffing QUIC
+)
+
+var sniffer = &sniff.Sniffer{MaxBytes: sniffMaxBytes, Timeout: sniffTimeout}
+
+// sniffing wraps getAddr so that IP targets are replaced by the domain name
+// found in the TLS ClientHello or HTTP request the client sends, if enabled.
+// Deferred requests are left alone as their clients wait for the reply.
+func sniffing(getAddr handshake) handshake {
+	return func(c net.Conn, sess *session) (net.Conn, socks.Addr, error) {
+		c, tgt, err := getAddr(c, sess)
+		if !config.Sniff || err != nil || tgt[0] == socks.AtypDomainName {
+			return c, tgt, err
+		}
+		domain, c, err := sniffer.Sniff(c)
+		if err != nil {
+			return c, tgt, err
+		}
+		if domain != "" {
+			tgt = domainTarget(domain, tgt)
+		}
+		return c, tgt, nil
+	}
+}
+
+// domainTarget returns the address of domain at the port of tgt.
+func domainTarget(domain string, tgt socks.Addr) socks.Addr {
+	_, port, _ := net.SplitHostPort(tgt.String())
+	if a := socks.ParseAddr(net.JoinHostPort(domain, port)); a != nil {
+		return a
+	}
+	return tgt
+}
+
+// sniffPacketConn sends datagrams to IP targets to the domain name their QUIC
+// Initial packets carry instead, holding them back until it is known. Replies
+// to such targets are made to come from their IPs. Datagrams are prefixed
+// with their target or source address.
+type sniffPacketConn struct {
+	net.PacketConn
+	sync.Mutex
+	targets map[string]*sniffTarget // by IP target
+	sources replySources
+}
+
+// sniffTarget is an IP target being sniffed, or whose domain is known.
+type sniffTarget struct {
+	tgt      socks.Addr
+	sniffing bool
+	held     [][]byte // payloads while sniffing
+	server   net.Addr
+	timer    *time.Timer
+	domain   socks.Addr // nil if not found
+}
+
+func newSniffPacketConn(pc net.PacketConn) net.PacketConn {
+	return &sniffPacketConn{PacketConn: pc, targets: make(map[string]*sniffTarget)}
+}
+
+func (c *sniffPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.SplitAddr(b)
+	if tgt == nil || tgt[0] == socks.AtypDomainName {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	c.Lock()
+	defer c.Unlock()
+	t, ok := c.targets[string(tgt)]
+	if !ok {
+		// b is the caller's buffer, reused for the datagrams to come
+		t = &sniffTarget{tgt: append(socks.Addr(nil), tgt...), sniffing: true, server: addr}
+		c.targets[string(tgt)] = t
+		t.timer = time.AfterFunc(sniffTimeout, func() {
+			c.Lock()
+			defer c.Unlock()
+			c.decide(t, "")
+		})
+	}
+	if !t.sniffing {
+		return c.write(b[len(tgt):], t)
+	}
+	t.held = append(t.held, append([]byte(nil), b[len(tgt):]...))
+	domain, err := sniff.QUIC(t.held...)
+	if err != sniff.ErrIncomplete || len(t.held) >= sniffMaxPackets {
+		c.decide(t, domain)
+	}
+	return len(b), nil
+}
+
+// decide ends sniffing t, sending the datagrams held back. Called locked.
+func (c *sniffPacketConn) decide(t *sniffTarget, domain string) {
+	if !t.sniffing {
+		return
+	}
+	t.sniffing = false
+	t.timer.Stop()
+	if domain != "" {
+		t.domain = domainTarget(domain, t.tgt)
+		logf("UDP sniffed %s for %s", domain, t.tgt)
+	}
+	c.sources.Add(t.tgt, t.domain != nil)
+	for _, p := range t.held {
+		if _, err := c.write(p, t); err != nil {
+			logf("UDP local write error: %v", err)
+		}
+	}
+	t.held = nil
+}
+
+// write sends payload p for t.
+func (c *sniffPacketConn) write(p []byte, t *sniffTarget) (int, error) {
+	dst := t.tgt
+	if t.domain != nil {
+		dst = t.domain
+	}
+	return c.PacketConn.WriteTo(append(append([]byte(nil), dst...), p...), t.server)
+}
+
+func (c *sniffPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	return c.sources.Rewrite(b, n), addr, nil
+}
@@ -0,0 +1,196 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// QUIC version 1 (RFC 9001 section 5.2)
+var quicV1Salt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// QUIC returns the server name of the ClientHello carried by the Initial
+// packets of datagrams, the first ones a client sent on a QUIC connection.
+// Large ClientHellos span several datagrams.
+func QUIC(datagrams ...[]byte) (string, error) {
+	crypto := make(map[uint64][]byte) // CRYPTO frame data by offset
+	for _, d := range datagrams {
+		if err := quicDatagram(d, crypto); err != nil {
+			return "", err
+		}
+	}
+
+	// the ClientHello from the start of the CRYPTO stream, whose frames may
+	// come in any order and overlap
+	var msg []byte
+	for more := true; more; {
+		more = false
+		for off, b := range crypto {
+			end := off + uint64(len(b))
+			if off <= uint64(len(msg)) && end > uint64(len(msg)) {
+				msg = append(msg, b[uint64(len(msg))-off:]...)
+				more = true
+			}
+		}
+	}
+	return clientHello(msg)
+}
+
+// quicDatagram collects the CRYPTO frames of the Initial packets in d.
+func quicDatagram(d []byte, crypto map[uint64][]byte) error {
+	if len(d) == 0 || d[0]&0x80 == 0 {
+		return ErrNotFound // not starting with a long header packet
+	}
+	for len(d) > 0 {
+		if d[0]&0x80 == 0 { // short header or padding, no more Initial packets
+			return nil
+		}
+		if len(d) < 5 || d[0]&0x40 == 0 {
+			return ErrNotFound
+		}
+		if binary.BigEndian.Uint32(d[1:]) != 1 {
+			return ErrNotFound // other versions are not supported
+		}
+		p := parser(d[5:])
+		dcid := p.bytes(int(p.uint8()))
+		p.skip(int(p.uint8())) // source connection ID
+		initial := d[0]&0x30 == 0
+		if initial {
+			p.skip(int(p.varint())) // token
+		}
+		length := p.varint()
+		if p == nil || length > uint64(len(p)) {
+			return ErrNotFound
+		}
+		hdrLen := len(d) - len(p)
+		pkt := d[:hdrLen+int(length)]
+		d = d[len(pkt):]
+		if !initial {
+			continue
+		}
+		payload, err := quicOpen(pkt, hdrLen, dcid)
+		if err != nil {
+			return err
+		}
+		if err := quicFrames(payload, crypto); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quicOpen removes the protection of the Initial packet pkt, whose packet
+// number starts at pnOff, and returns its decrypted payload.
+func quicOpen(pkt []byte, pnOff int, dcid []byte) ([]byte, error) {
+	secret := hkdf.Extract(sha256.New, dcid, quicV1Salt)
+	client := hkdfExpandLabel(secret, "client in", 32)
+	key := hkdfExpandLabel(client, "quic key", 16)
+	iv := hkdfExpandLabel(client, "quic iv", 12)
+	hp := hkdfExpandLabel(client, "quic hp", 16)
+
+	if len(pkt) < pnOff+4+16 {
+		return nil, ErrNotFound
+	}
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, 16)
+	block.Encrypt(mask, pkt[pnOff+4:pnOff+4+16])
+
+	hdr := append([]byte(nil), pkt[:pnOff+4]...) // leave the datagram alone
+	hdr[0] ^= mask[0] & 0x0f
+	pnLen := int(hdr[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		hdr[pnOff+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(hdr[pnOff+i])
+	}
+	hdr = hdr[:pnOff+pnLen]
+
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := iv
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * uint(i)))
+	}
+	payload, err := aead.Open(nil, nonce, pkt[pnOff+pnLen:], hdr)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return payload, nil
+}
+
+// quicFrames collects the CRYPTO frames of payload.
+func quicFrames(payload []byte, crypto map[uint64][]byte) error {
+	p := parser(payload)
+	for len(p) > 0 {
+		switch typ := p.varint(); typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			p.varint() // largest acknowledged
+			p.varint() // delay
+			n := p.varint()
+			p.varint() // first range
+			for i := uint64(0); i < n && p != nil; i++ {
+				p.varint() // gap
+				p.varint() // range length
+			}
+			if typ == 0x03 {
+				p.varint() // ECN counts
+				p.varint()
+				p.varint()
+			}
+		case 0x06: // CRYPTO
+			off := p.varint()
+			data := p.bytes(int(p.varint()))
+			if data != nil {
+				crypto[off] = data
+			}
+		default:
+			return nil // nothing of interest past other frames
+		}
+		if p == nil {
+			return ErrNotFound
+		}
+	}
+	return nil
+}
+
+// varint reads a QUIC variable-length integer.
+func (p *parser) varint() uint64 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for rest := p.bytes(1<<(b[0]>>6) - 1); len(rest) > 0; rest = rest[1:] {
+		v = v<<8 | uint64(rest[0])
+	}
+	return v
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context.
+func hkdfExpandLabel(secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 2+1+len(label)+1)
+	info = append(info, byte(n>>8), byte(n), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, n)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, info), out)
+	return out
+}
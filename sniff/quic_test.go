@@ -0,0 +1,127 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 9001 appendix A.1
+func TestQUICInitialKeys(t *testing.T) {
+	secret := hkdf.Extract(sha256.New, unhex("8394c8f03e515708"), quicV1Salt)
+	client := hkdfExpandLabel(secret, "client in", 32)
+	for _, k := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"client secret", client, "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea"},
+		{"key", hkdfExpandLabel(client, "quic key", 16), "1f369613dd76d5467730efcbe3b1a22d"},
+		{"iv", hkdfExpandLabel(client, "quic iv", 12), "fa044b2f42a3fd3b46fb255c"},
+		{"hp", hkdfExpandLabel(client, "quic hp", 16), "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if !bytes.Equal(k.got, unhex(k.want)) {
+			t.Errorf("%s: got %x, want %s", k.name, k.got, k.want)
+		}
+	}
+}
+
+// quicInitial returns a client Initial packet for dcid with packet number pn
+// carrying frames, protected as in RFC 9001 section 5.
+func quicInitial(dcid []byte, pn uint32, frames []byte) []byte {
+	secret := hkdf.Extract(sha256.New, dcid, quicV1Salt)
+	client := hkdfExpandLabel(secret, "client in", 32)
+	key := hkdfExpandLabel(client, "quic key", 16)
+	iv := hkdfExpandLabel(client, "quic iv", 12)
+	hp := hkdfExpandLabel(client, "quic hp", 16)
+
+	length := 4 + len(frames) + 16 // packet number, payload, tag
+	hdr := []byte{0xc3, 0, 0, 0, 1, byte(len(dcid))}
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, 0, 0, 0x40|byte(length>>8), byte(length)) // SCID, token, length
+	pnOff := len(hdr)
+	hdr = append(hdr, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	for i := 0; i < 4; i++ {
+		iv[len(iv)-1-i] ^= byte(pn >> (8 * uint(i)))
+	}
+	pkt := aead.Seal(hdr, iv, frames, hdr)
+
+	block, _ = aes.NewCipher(hp)
+	mask := make([]byte, 16)
+	block.Encrypt(mask, pkt[pnOff+4:pnOff+4+16])
+	pkt[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		pkt[pnOff+i] ^= mask[1+i]
+	}
+	return pkt
+}
+
+func quicVarint(v int) []byte {
+	return []byte{0x80 | byte(v>>24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// cryptoFrame returns a CRYPTO frame with data at off.
+func cryptoFrame(off int, data []byte) []byte {
+	f := append([]byte{0x06}, quicVarint(off)...)
+	f = append(f, quicVarint(len(data))...)
+	return append(f, data...)
+}
+
+func TestQUIC(t *testing.T) {
+	hello := tlsClientHello(t, "example.com")[5:] // the handshake message
+	dcid := unhex("8394c8f03e515708")
+	n := len(hello) / 2
+	whole := quicInitial(dcid, 0, append(cryptoFrame(0, hello), make([]byte, 20)...)) // padded
+	first := quicInitial(dcid, 0, cryptoFrame(0, hello[:n]))
+	second := quicInitial(dcid, 1, cryptoFrame(n, hello[n:]))
+	ack := []byte{0x02, 0, 0, 0, 0} // ACK of packet 0 with no delay and ranges
+	withAck := quicInitial(dcid, 2, append(ack, cryptoFrame(0, hello)...))
+	corrupt := append([]byte(nil), whole...)
+	corrupt[len(corrupt)-1] ^= 1
+	otherVersion := append([]byte(nil), whole...)
+	otherVersion[4] = 2
+
+	tests := []struct {
+		name      string
+		datagrams [][]byte
+		domain    string
+		err       error
+	}{
+		{"single packet", [][]byte{whole}, "example.com", nil},
+		{"split over datagrams", [][]byte{first, second}, "example.com", nil},
+		{"datagrams out of order", [][]byte{second, first}, "example.com", nil},
+		{"coalesced packets", [][]byte{append(append([]byte(nil), first...), second...)}, "example.com", nil},
+		{"after an ACK frame", [][]byte{withAck}, "example.com", nil},
+		{"first half only", [][]byte{first}, "", ErrIncomplete},
+		{"second half only", [][]byte{second}, "", ErrIncomplete},
+		{"corrupt", [][]byte{corrupt}, "", ErrNotFound},
+		{"other version", [][]byte{otherVersion}, "", ErrNotFound},
+		{"short header", [][]byte{{0x40, 1, 2, 3}}, "", ErrNotFound},
+		{"truncated", [][]byte{whole[:30]}, "", ErrNotFound},
+		{"DNS", [][]byte{unhex("123401000001000000000000076578616d706c6503636f6d0000010001")}, "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain, err := QUIC(tt.datagrams...)
+			if domain != tt.domain || err != tt.err {
+				t.Errorf("got %q, %v; want %q, %v", domain, err, tt.domain, tt.err)
+			}
+		})
+	}
+}
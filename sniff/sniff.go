@@ -0,0 +1,244 @@
+// Package sniff finds the domain name a client is after in the first bytes
+// it sends: the server name of a TLS ClientHello, the Host header of an HTTP
+// request, or the server name of a QUIC Initial packet.
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/netutil"
+)
+
+var (
+	// ErrIncomplete means that more data may reveal a domain.
+	ErrIncomplete = errors.New("sniff: incomplete data")
+	// ErrNotFound means that the data carries no domain name.
+	ErrNotFound = errors.New("sniff: no domain found")
+)
+
+// Sniffer reads the first bytes of streams within a budget.
+type Sniffer struct {
+	MaxBytes int           // read no more than this
+	Timeout  time.Duration // wait no longer than this for the client to send
+}
+
+// Sniff reads from c until a TLS ClientHello or an HTTP request reveals a
+// domain name, the data matches neither, or the budget runs out. It returns
+// the domain name, empty if none was found, and a connection replaying the
+// bytes read. Errors are those of reading c.
+func (s *Sniffer) Sniff(c net.Conn) (string, net.Conn, error) {
+	buf := make([]byte, s.MaxBytes)
+	n := 0
+	c.SetReadDeadline(time.Now().Add(s.Timeout))
+	defer c.SetReadDeadline(time.Time{})
+	for n < len(buf) {
+		m, err := c.Read(buf[n:])
+		n += m
+		if m > 0 {
+			domain, serr := Stream(buf[:n])
+			if serr != ErrIncomplete {
+				return domain, &replayConn{Conn: c, buf: buf[:n]}, nil
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break // the client sent nothing more in time
+			}
+			return "", &replayConn{Conn: c, buf: buf[:n]}, err
+		}
+	}
+	return "", &replayConn{Conn: c, buf: buf[:n]}, nil
+}
+
+// Stream returns the domain name in the first bytes b of a TLS or HTTP stream.
+func Stream(b []byte) (string, error) {
+	domain, err := TLS(b)
+	if err == ErrNotFound {
+		domain, err = HTTP(b)
+	}
+	return domain, err
+}
+
+// replayConn returns buf before reading on from the connection.
+type replayConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the connection, if it can.
+func (c *replayConn) CloseWrite() error { return netutil.CloseWrite(c.Conn) }
+
+// TLS returns the server name of the ClientHello starting stream b, which may
+// span several handshake records.
+func TLS(b []byte) (string, error) {
+	var msg []byte // handshake messages reassembled from records
+	for len(b) > 0 {
+		if b[0] != 0x16 { // handshake
+			return "", ErrNotFound
+		}
+		if len(b) < 5 {
+			return "", ErrIncomplete
+		}
+		if b[1] != 3 {
+			return "", ErrNotFound
+		}
+		n := int(binary.BigEndian.Uint16(b[3:]))
+		if len(b) < 5+n {
+			msg = append(msg, b[5:]...)
+			break
+		}
+		msg = append(msg, b[5:5+n]...)
+		b = b[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+int(msg[1])<<16|int(msg[2])<<8|int(msg[3]) {
+			break
+		}
+	}
+	return clientHello(msg)
+}
+
+// clientHello returns the server name of handshake message b, which must be
+// a ClientHello.
+func clientHello(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", ErrIncomplete
+	}
+	if b[0] != 1 { // ClientHello
+		return "", ErrNotFound
+	}
+	if len(b) < 4 {
+		return "", ErrIncomplete
+	}
+	n := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if len(b) < 4+n {
+		return "", ErrIncomplete
+	}
+	p := parser(b[4 : 4+n])
+	if !p.skip(2+32) || // version, random
+		!p.skip(int(p.uint8())) || // session ID
+		!p.skip(int(p.uint16())) || // cipher suites
+		!p.skip(int(p.uint8())) { // compression methods
+		return "", ErrNotFound
+	}
+	exts := parser(p.bytes(int(p.uint16())))
+	for len(exts) >= 4 {
+		typ := exts.uint16()
+		ext := parser(exts.bytes(int(exts.uint16())))
+		if ext == nil {
+			break
+		}
+		if typ != 0 { // server_name
+			continue
+		}
+		list := parser(ext.bytes(int(ext.uint16())))
+		for len(list) >= 3 {
+			kind := list.uint8()
+			name := list.bytes(int(list.uint16()))
+			if kind == 0 && name != nil { // host_name
+				return domain(string(name))
+			}
+		}
+		break
+	}
+	return "", ErrNotFound
+}
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// HTTP returns the host of the Host header of the request starting stream b.
+func HTTP(b []byte) (string, error) {
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		if len(b) > len("OPTIONS") {
+			return "", ErrNotFound
+		}
+		for _, m := range httpMethods {
+			if strings.HasPrefix(m, string(b)) {
+				return "", ErrIncomplete
+			}
+		}
+		return "", ErrNotFound
+	}
+	method := string(b[:i])
+	known := false
+	for _, m := range httpMethods {
+		known = known || m == method
+	}
+	if !known {
+		return "", ErrNotFound
+	}
+
+	for first := true; ; first = false {
+		i := bytes.Index(b, []byte("\r\n"))
+		if i < 0 {
+			return "", ErrIncomplete
+		}
+		line := string(b[:i])
+		b = b[i+2:]
+		if first {
+			continue // request line
+		}
+		if line == "" {
+			return "", ErrNotFound // end of headers
+		}
+		if j := strings.IndexByte(line, ':'); j > 0 && strings.EqualFold(line[:j], "Host") {
+			host := strings.TrimSpace(line[j+1:])
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return domain(host)
+		}
+	}
+}
+
+// domain returns name if it is a domain name rather than an IP address.
+func domain(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || len(name) > 255 || net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return "", ErrNotFound
+	}
+	return name, nil
+}
+
+// parser reads big-endian values off a byte slice, becoming nil once it runs
+// out of data.
+type parser []byte
+
+func (p *parser) bytes(n int) []byte {
+	if *p == nil || n < 0 || n > len(*p) {
+		*p = nil
+		return nil
+	}
+	b := (*p)[:n:n]
+	*p = (*p)[n:]
+	return b
+}
+
+func (p *parser) skip(n int) bool { return p.bytes(n) != nil }
+
+func (p *parser) uint8() uint8 {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *parser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
@@ -0,0 +1,184 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsClientHello returns the first flight of a TLS client asking for serverName.
+func tlsClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer c.Close()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(s, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(hdr, body...)
+}
+
+// splitRecord splits the single handshake record rec into two records, the
+// first holding n bytes of the message.
+func splitRecord(rec []byte, n int) []byte {
+	msg := rec[5:]
+	first := append([]byte{rec[0], rec[1], rec[2], byte(n >> 8), byte(n)}, msg[:n]...)
+	rest := len(msg) - n
+	return append(append(first, rec[0], rec[1], rec[2], byte(rest>>8), byte(rest)), msg[n:]...)
+}
+
+func TestTLS(t *testing.T) {
+	hello := tlsClientHello(t, "Example.COM")
+	split := splitRecord(hello, 40)
+	tests := []struct {
+		name   string
+		b      []byte
+		domain string
+		err    error
+	}{
+		{"client hello", hello, "example.com", nil},
+		{"split over records", split, "example.com", nil},
+		{"followed by more data", append(append([]byte(nil), hello...), 0x17, 3, 3, 0, 1, 0), "example.com", nil},
+		{"empty", nil, "", ErrIncomplete},
+		{"record header only", hello[:5], "", ErrIncomplete},
+		{"partial record", hello[:len(hello)-1], "", ErrIncomplete},
+		{"first of split records", split[:5+40], "", ErrIncomplete},
+		{"partial record header", split[:5+40+3], "", ErrIncomplete},
+		{"not a handshake", []byte{0x17, 3, 3, 0, 1, 0}, "", ErrNotFound},
+		{"not TLS", []byte("GET / HTTP/1.1\r\n"), "", ErrNotFound},
+		{"not a client hello", []byte{0x16, 3, 3, 0, 4, 2, 0, 0, 0}, "", ErrNotFound},
+		{"no server name", tlsClientHello(t, ""), "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain, err := TLS(tt.b)
+			if domain != tt.domain || err != tt.err {
+				t.Errorf("got %q, %v; want %q, %v", domain, err, tt.domain, tt.err)
+			}
+		})
+	}
+
+	// no prefix of a client hello is read past
+	for n := range hello {
+		if _, err := TLS(hello[:n]); err != ErrIncomplete {
+			t.Errorf("prefix of %d bytes: %v", n, err)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      string
+		domain string
+		err    error
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: Example.com\r\n\r\n", "example.com", nil},
+		{"host and port", "POST /x HTTP/1.1\r\nUser-Agent: t\r\nhost: example.com:8080\r\n\r\n", "example.com", nil},
+		{"IPv6 host", "GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n", "", ErrNotFound},
+		{"IP host", "GET / HTTP/1.1\r\nHost: 1.2.3.4\r\n\r\n", "", ErrNotFound},
+		{"no host", "GET / HTTP/1.0\r\nAccept: */*\r\n\r\n", "", ErrNotFound},
+		{"partial method", "OPT", "", ErrIncomplete},
+		{"partial request line", "GET /index.ht", "", ErrIncomplete},
+		{"partial headers", "GET / HTTP/1.1\r\nAccept: */*\r\nHo", "", ErrIncomplete},
+		{"unknown method", "BREW / HTCPCP/1.0\r\n\r\n", "", ErrNotFound},
+		{"not HTTP", "\x16\x03\x01", "", ErrNotFound},
+		{"long first word", "SSH-2.0-OpenSSH_9.0", "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain, err := HTTP([]byte(tt.b))
+			if domain != tt.domain || err != tt.err {
+				t.Errorf("got %q, %v; want %q, %v", domain, err, tt.domain, tt.err)
+			}
+		})
+	}
+}
+
+func TestSniffer(t *testing.T) {
+	hello := tlsClientHello(t, "example.com")
+	s := &Sniffer{MaxBytes: 8192, Timeout: 100 * time.Millisecond}
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		domain string
+	}{
+		{"in one read", [][]byte{hello}, "example.com"},
+		{"in several reads", [][]byte{hello[:3], hello[3:50], hello[50:]}, "example.com"},
+		{"HTTP", [][]byte{[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}, "example.com"},
+		{"other protocol", [][]byte{[]byte("SSH-2.0-OpenSSH_9.0\r\n")}, ""},
+		{"single byte", nil, ""},
+		{"over budget", [][]byte{[]byte("GET /" + strings.Repeat("a", 9000))}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, peer := net.Pipe()
+			defer c.Close()
+			go func() {
+				for _, b := range tt.chunks {
+					peer.Write(b)
+				}
+				peer.Write([]byte("!")) // after the sniffed bytes
+			}()
+			defer peer.Close()
+
+			domain, rc, err := s.Sniff(c)
+			if err != nil || domain != tt.domain {
+				t.Fatalf("got %q, %v; want %q", domain, err, tt.domain)
+			}
+			// the bytes read are replayed, followed by the rest
+			want := string(joinChunks(tt.chunks)) + "!"
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(rc, got); err != nil || string(got) != want {
+				t.Errorf("replayed %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func joinChunks(chunks [][]byte) []byte {
+	var b []byte
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// halfConn records CloseWrite calls.
+type halfConn struct {
+	net.Conn
+	closedWrite bool
+}
+
+func (c *halfConn) CloseWrite() error {
+	c.closedWrite = true
+	return nil
+}
+
+func TestReplayConnCloseWrite(t *testing.T) {
+	c, peer := net.Pipe()
+	defer c.Close()
+	defer peer.Close()
+	hc := &halfConn{Conn: c}
+	go peer.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	_, rc, err := (&Sniffer{MaxBytes: 1024, Timeout: time.Second}).Sniff(hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, ok := rc.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("sniffed connection cannot close for writing")
+	}
+	if err := cw.CloseWrite(); err != nil || !hc.closedWrite {
+		t.Errorf("CloseWrite not forwarded: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// A QUIC Initial packet carrying the first 64 bytes of a ClientHello, leaving
+// the server name to packets yet to come.
+const quicPartialHello = "c5000000010800010203040506070000405d31c0470d1cb6e70379f16b033219a498a9ed81a719d7c272101db8cfe5d73f84b657eb9cf28388e14c42710da8d0064955df9f7604708c6a34ef244d3b992d547f807ac7d3eb4989fcc026796a7d1f86482d18ed1ad5a7ed58d6f569ff"
+
+func TestSniffPacketConnHeldTarget(t *testing.T) {
+	inner := &packetRecorder{}
+	c := newSniffPacketConn(inner).(*sniffPacketConn)
+	quic, _ := hex.DecodeString(quicPartialHello)
+	quicTgt := socks.ParseAddr("1.2.3.4:443")
+	dnsTgt := socks.ParseAddr("9.9.9.9:53")
+
+	// the caller reuses its buffer for every datagram
+	buf := make([]byte, 2048)
+	n := copy(buf, quicTgt)
+	n += copy(buf[n:], quic)
+	c.WriteTo(buf[:n], nil)
+	n = copy(buf, dnsTgt)
+	n += copy(buf[n:], "query")
+	c.WriteTo(buf[:n], nil)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+
+	time.Sleep(sniffTimeout + 100*time.Millisecond)
+	c.Lock() // held by the timer sending the QUIC packet
+	defer c.Unlock()
+	want := [][]byte{append(append([]byte(nil), dnsTgt...), "query"...), append(append([]byte(nil), quicTgt...), quic...)}
+	if len(inner.written) != len(want) {
+		t.Fatalf("sent %d datagrams, want %d", len(inner.written), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(inner.written[i], want[i]) {
+			t.Errorf("datagram %d: got %x, want %x", i, inner.written[i], want[i])
+		}
+	}
+}
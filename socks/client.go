@@ -0,0 +1,268 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrInvalidAddr means that an address cannot be sent in a SOCKS request.
+var ErrInvalidAddr = errors.New("invalid SOCKS address")
+
+// A Dialer connects to targets through a SOCKS5 proxy.
+type Dialer struct {
+	ProxyAddress string // host:port of the proxy
+
+	// Username and Password authenticate to the proxy as in RFC 1929 if
+	// Username is not empty. No authentication is offered otherwise.
+	Username, Password string
+
+	// Forward dials the proxy. A zero net.Dialer is used if nil.
+	Forward interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}
+}
+
+// Dial is like DialContext with a background context.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the proxy. Only the "tcp", "tcp4"
+// and "tcp6" networks are supported; address may name a host the proxy will
+// resolve. A SOCKS error is returned if the proxy refuses the request.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	tgt := ParseAddr(address)
+	if tgt == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrInvalidAddr}
+	}
+	c, _, err := d.request(ctx, CmdConnect, tgt)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return c, nil
+}
+
+// ListenPacket sends a UDP ASSOCIATE request to the proxy and returns a
+// net.PacketConn relaying datagrams through it. Datagrams may be addressed to
+// a *net.UDPAddr or any net.Addr whose String is a host:port. The association
+// lasts until the PacketConn is closed or the proxy ends it.
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	// Announce the port datagrams come from; the proxy knows our IP better.
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	c, bnd, err := d.request(ctx, CmdUDPAssociate, ParseAddr(net.JoinHostPort("0.0.0.0", port)))
+	if err != nil {
+		pc.Close()
+		return nil, &net.OpError{Op: "listen", Net: "udp", Err: err}
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", bnd.String())
+	if err == nil && relay.IP.IsUnspecified() {
+		// the relay listens on the address the proxy was reached on
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = addr.IP
+		}
+	}
+	if err != nil {
+		pc.Close()
+		c.Close()
+		return nil, &net.OpError{Op: "listen", Net: "udp", Err: err}
+	}
+
+	upc := &udpConn{PacketConn: pc, ctrl: c, relay: relay}
+	go func() {
+		io.Copy(ioutil.Discard, c) // the association ends with the control connection
+		pc.Close()
+	}()
+	return upc, nil
+}
+
+// request dials the proxy, authenticates and sends the request cmd for addr.
+// Returns the connection to the proxy and the bound address replied.
+func (d *Dialer) request(ctx context.Context, cmd byte, addr Addr) (net.Conn, Addr, error) {
+	var fwd interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	} = &net.Dialer{}
+	if d.Forward != nil {
+		fwd = d.Forward
+	}
+	c, err := fwd.DialContext(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := bindContext(ctx, c)
+	bnd, err := d.handshake(c, cmd, addr)
+	if cerr := stop(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, bnd, nil
+}
+
+// handshake performs the client side of the SOCKS5 negotiation and request.
+func (d *Dialer) handshake(rw io.ReadWriter, cmd byte, addr Addr) (Addr, error) {
+	// write VER NMETHODS METHODS
+	methods := []byte{MethodNoAuth}
+	if d.Username != "" {
+		methods = []byte{MethodUserPass}
+	}
+	if _, err := rw.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	// read VER METHOD
+	buf := make([]byte, MaxAddrLen)
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != 5 || buf[1] != methods[0] {
+		return nil, ErrAuthFailed
+	}
+
+	if buf[1] == MethodUserPass {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return nil, ErrAuthFailed
+		}
+		// write VER ULEN UNAME PLEN PASSWD
+		b := append([]byte{1, byte(len(d.Username))}, d.Username...)
+		b = append(append(b, byte(len(d.Password))), d.Password...)
+		if _, err := rw.Write(b); err != nil {
+			return nil, err
+		}
+		// read VER STATUS
+		if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, ErrAuthFailed
+		}
+	}
+
+	// write VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := rw.Write(append([]byte{5, cmd, 0}, addr...)); err != nil {
+		return nil, err
+	}
+	// read VER REP RSV ATYP BND.ADDR BND.PORT
+	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
+		return nil, err
+	}
+	if buf[1] != 0 {
+		return nil, Error(buf[1])
+	}
+	return readAddr(rw, buf)
+}
+
+// bindContext applies the deadline and cancellation of ctx to c until the
+// returned function is called. The function returns ctx.Err().
+func bindContext(ctx context.Context, c net.Conn) func() error {
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0)) // abort pending I/O
+		case <-done:
+		}
+	}()
+	return func() error {
+		close(done)
+		<-exited
+		c.SetDeadline(time.Time{})
+		return ctx.Err()
+	}
+}
+
+// udpConn is a net.PacketConn relaying through a SOCKS5 UDP association.
+type udpConn struct {
+	net.PacketConn // the local UDP socket
+	ctrl           net.Conn
+	relay          *net.UDPAddr
+
+	mu  sync.Mutex // guards buf
+	buf []byte     // datagrams read with their header
+}
+
+// WriteTo sends b to addr through the relay. Fragmentation is not supported.
+func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: ErrInvalidAddr}
+	}
+	// write RSV FRAG ATYP DST.ADDR DST.PORT DATA
+	pkt := make([]byte, 0, 3+len(tgt)+len(b))
+	pkt = append(append(append(pkt, 0, 0, 0), tgt...), b...)
+	if _, err := c.PacketConn.WriteTo(pkt, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads a datagram from the relay into b, skipping datagrams from
+// other sources, fragments and malformed ones. The source is a *net.UDPAddr
+// unless the proxy reports a domain name.
+func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buf) < 3+MaxAddrLen+len(b) {
+		c.buf = make([]byte, 3+MaxAddrLen+len(b))
+	}
+	buf := c.buf[:3+MaxAddrLen+len(b)]
+	for {
+		n, raddr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if from, ok := raddr.(*net.UDPAddr); !ok || !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+		frag, src, data, err := ParseDatagram(buf[:n])
+		if err != nil || frag != 0 {
+			continue
+		}
+		return copy(b, data), src.netAddr(), nil
+	}
+}
+
+// Close ends the association.
+func (c *udpConn) Close() error {
+	c.ctrl.Close()
+	return c.PacketConn.Close()
+}
+
+// netAddr returns a as a *net.UDPAddr, or as a net.Addr naming its host and
+// port if a holds a domain name.
+func (a Addr) netAddr() net.Addr {
+	if a[0] != AtypDomainName {
+		host, port, _ := net.SplitHostPort(a.String())
+		p, _ := strconv.Atoi(port)
+		return &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	return domainAddr(a.String())
+}
+
+// domainAddr is a UDP address holding a domain name.
+type domainAddr string
+
+func (a domainAddr) Network() string { return "udp" }
+func (a domainAddr) String() string  { return string(a) }
@@ -0,0 +1,158 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// An Authenticator authenticates SOCKS5 clients with one method.
+type Authenticator interface {
+	// Method returns the method as defined in RFC 1928 section 3.
+	Method() byte
+	// Authenticate runs the method-specific subnegotiation after the method
+	// was selected. Returns the authenticated user name, if any.
+	Authenticate(rw io.ReadWriter) (user string, err error)
+}
+
+// NoAuth accepts clients without authentication.
+type NoAuth struct{}
+
+// Method returns MethodNoAuth.
+func (NoAuth) Method() byte { return MethodNoAuth }
+
+// Authenticate accepts any client anonymously.
+func (NoAuth) Authenticate(io.ReadWriter) (string, error) { return "", nil }
+
+// UserPassAuth authenticates clients with RFC 1929 username/password pairs.
+type UserPassAuth struct {
+	Credentials Credentials
+}
+
+// Method returns MethodUserPass.
+func (UserPassAuth) Method() byte { return MethodUserPass }
+
+// Authenticate checks the username and password sent by the client.
+func (a UserPassAuth) Authenticate(rw io.ReadWriter) (string, error) {
+	return authenticate(rw, a.Credentials)
+}
+
+// A Request is a SOCKS5 request read by a Server.
+type Request struct {
+	Command byte     // CmdConnect, CmdBind or CmdUDPAssociate
+	Addr    Addr     // DST.ADDR and DST.PORT
+	User    string   // authenticated user name, if any
+	Conn    net.Conn // the client connection
+
+	replied bool
+}
+
+// Reply writes a reply to the request, see Reply. Only the first call writes;
+// a BIND request gets two replies by calling it twice.
+func (r *Request) Reply(err error, bnd Addr) error {
+	if r.replied && r.Command != CmdBind {
+		return nil
+	}
+	r.replied = true
+	return Reply(r.Conn, err, bnd)
+}
+
+// Replied reports whether a reply has been written.
+func (r *Request) Replied() bool { return r.replied }
+
+// A Handler serves SOCKS5 requests. Each method owns the client connection
+// until it returns and must reply by calling req.Reply. If it returns an
+// error without replying, the Server replies with it. The context is canceled
+// when the method returns.
+type Handler interface {
+	Connect(ctx context.Context, req *Request) error
+	UDPAssociate(ctx context.Context, req *Request) error
+	Bind(ctx context.Context, req *Request) error
+}
+
+// Server is a SOCKS5 server.
+type Server struct {
+	Handler Handler
+
+	// Authenticators lists the accepted methods in order of preference.
+	// Clients are accepted without authentication if empty.
+	Authenticators []Authenticator
+
+	// HandshakeTimeout bounds the time from accepting a connection to reading
+	// its request. Zero means no timeout.
+	HandshakeTimeout time.Duration
+}
+
+// Serve accepts connections on l and serves each in a new goroutine, until l
+// fails to accept.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			s.ServeConn(context.Background(), c)
+		}()
+	}
+}
+
+// ServeConn reads a request from c and hands it to the Handler. The caller
+// closes c once it returns.
+func (s *Server) ServeConn(ctx context.Context, c net.Conn) error {
+	req, err := s.Handshake(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	switch req.Command {
+	case CmdConnect:
+		err = s.Handler.Connect(ctx, req)
+	case CmdUDPAssociate:
+		err = s.Handler.UDPAssociate(ctx, req)
+	case CmdBind:
+		err = s.Handler.Bind(ctx, req)
+	}
+	if err != nil && !req.replied {
+		req.Reply(err, nil)
+	}
+	return err
+}
+
+// Handshake authenticates the client of c and reads its request without
+// replying, for callers dispatching requests on their own. Unknown commands
+// and address types are rejected.
+func (s *Server) Handshake(c net.Conn) (*Request, error) {
+	if s.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+		defer c.SetDeadline(time.Time{})
+	}
+
+	auths := s.Authenticators
+	if len(auths) == 0 {
+		auths = []Authenticator{NoAuth{}}
+	}
+	buf := make([]byte, MaxAddrLen)
+	user, err := negotiate(c, buf, auths)
+	if err != nil {
+		return nil, err
+	}
+	cmd, addr, err := readRequest(c, buf)
+	if err == ErrAddressNotSupported {
+		Reply(c, err, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{Command: cmd, Addr: append(Addr(nil), addr...), User: user, Conn: c}
+	switch cmd {
+	case CmdConnect, CmdBind, CmdUDPAssociate:
+		return req, nil
+	}
+	req.Reply(ErrCommandNotSupported, nil)
+	return nil, ErrCommandNotSupported
+}
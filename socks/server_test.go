@@ -0,0 +1,153 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoHandler echoes CONNECT requests back and fails the others, passing
+// each request to reqs.
+type echoHandler struct {
+	reqs chan *Request
+}
+
+func (h echoHandler) Connect(ctx context.Context, req *Request) error {
+	h.reqs <- req
+	if err := req.Reply(nil, nil); err != nil {
+		return err
+	}
+	_, err := io.Copy(req.Conn, req.Conn)
+	return err
+}
+
+func (h echoHandler) UDPAssociate(ctx context.Context, req *Request) error {
+	h.reqs <- req
+	return ErrConnectionRefused // replied by the Server
+}
+
+func (h echoHandler) Bind(ctx context.Context, req *Request) error {
+	h.reqs <- req
+	return errors.New("no BIND") // replied as a general failure
+}
+
+func serve(t *testing.T, s *Server) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l
+}
+
+func TestServer(t *testing.T) {
+	h := echoHandler{make(chan *Request, 1)}
+	l := serve(t, &Server{Handler: h})
+	defer l.Close()
+	addr := l.Addr().String()
+	d := &Dialer{ProxyAddress: addr}
+
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := <-h.reqs
+	if req.Command != CmdConnect || req.Addr.String() != "example.com:80" || req.User != "" {
+		t.Errorf("request %d %s %q", req.Command, req.Addr, req.User)
+	}
+	c.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+		t.Errorf("echoed %q, %v", got, err)
+	}
+
+	_, err = d.ListenPacket(context.Background())
+	if !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("UDP ASSOCIATE: %v, want %v", err, ErrConnectionRefused)
+	}
+	if req := <-h.reqs; req.Command != CmdUDPAssociate {
+		t.Errorf("command %d, want UDP ASSOCIATE", req.Command)
+	}
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	rep, err := (&Dialer{}).handshake(raw, CmdBind, ParseAddr("1.2.3.4:80"))
+	if err != ErrGeneralFailure {
+		t.Errorf("BIND: %v %v, want %v", rep, err, ErrGeneralFailure)
+	}
+	<-h.reqs
+}
+
+func TestServerAuth(t *testing.T) {
+	h := echoHandler{make(chan *Request, 1)}
+	l := serve(t, &Server{
+		Handler:        h,
+		Authenticators: []Authenticator{UserPassAuth{StaticCredentials{"alice": "secret"}}},
+	})
+	defer l.Close()
+	addr := l.Addr().String()
+
+	c, err := (&Dialer{ProxyAddress: addr, Username: "alice", Password: "secret"}).Dial("tcp", "1.2.3.4:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if req := <-h.reqs; req.User != "alice" {
+		t.Errorf("user %q, want alice", req.User)
+	}
+
+	for _, d := range []*Dialer{
+		{ProxyAddress: addr, Username: "alice", Password: "wrong"},
+		{ProxyAddress: addr}, // no authentication offered
+	} {
+		if _, err := d.Dial("tcp", "1.2.3.4:80"); err == nil {
+			t.Errorf("user %q with password %q accepted", d.Username, d.Password)
+		}
+	}
+	select {
+	case req := <-h.reqs:
+		t.Errorf("unauthenticated request for %s served", req.Addr)
+	default:
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	s := &Server{Handler: echoHandler{make(chan *Request, 1)}, HandshakeTimeout: 50 * time.Millisecond}
+	c, peer := net.Pipe()
+	defer peer.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.ServeConn(context.Background(), c) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("silent client served")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake did not time out")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	c := &bufConn{Reader: bytes.NewReader([]byte("\x05\x01\x00\x05\x01\x00\x01\x01\x02\x03\x04\x00\x50"))}
+	addr, err := Handshake(c)
+	if err != nil || addr.String() != "1.2.3.4:80" {
+		t.Fatalf("got %x, %v", []byte(addr), err)
+	}
+	if want := "\x05\x00\x05\x00\x00\x01\x00\x00\x00\x00\x00\x00"; c.w.String() != want {
+		t.Errorf("replied %x, want %x", c.w.Bytes(), want)
+	}
+
+	c = &bufConn{Reader: bytes.NewReader([]byte("\x05\x01\x00\x05\x03\x00\x01\x01\x02\x03\x04\x00\x50"))}
+	if _, err := Handshake(c); err != ErrCommandNotSupported {
+		t.Errorf("UDP ASSOCIATE while disabled: %v", err)
+	}
+}
@@ -2,6 +2,8 @@
 package socks
 
 import (
+	"crypto/subtle"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -42,6 +44,8 @@ const (
 	ErrCommandNotSupported  = Error(7)
 	ErrAddressNotSupported  = Error(8)
 	InfoUDPAssociate        = Error(9)
+	InfoBind                = Error(10)
+	InfoConnect             = Error(11)
 )
 
 // MaxAddrLen is the maximum size of SOCKS address in bytes.
@@ -168,47 +172,176 @@ func ParseAddr(s string) Addr {
 	return addr
 }
 
-// Handshake fast-tracks SOCKS initialization to get target address to connect.
-func Handshake(rw io.ReadWriter) (Addr, error) {
-	// Read RFC 1928 for request and reply structure and sizes.
-	buf := make([]byte, MaxAddrLen)
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodUserPass     = 2
+	MethodNoAcceptable = 0xFF
+)
+
+// ErrAuthFailed means that the client could not authenticate.
+var ErrAuthFailed = errors.New("SOCKS authentication failed")
+
+// Credentials checks RFC 1929 username/password pairs.
+type Credentials interface {
+	Valid(user, password string) bool
+}
+
+// StaticCredentials are a fixed set of passwords by user name.
+type StaticCredentials map[string]string
+
+// Valid reports whether password is the password of user.
+func (s StaticCredentials) Valid(user, password string) bool {
+	p, ok := s[user]
+	return ok && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+}
+
+type anyCredentials struct{}
+
+func (anyCredentials) Valid(user, password string) bool { return true }
+
+// negotiate selects the first of auths whose method the client offers and
+// authenticates the client with it. Returns the authenticated user name, if
+// any.
+func negotiate(rw io.ReadWriter, buf []byte, auths []Authenticator) (string, error) {
 	// read VER, NMETHODS, METHODS
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return nil, err
+		return "", err
 	}
 	nmethods := buf[1]
 	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return nil, err
+		return "", err
+	}
+	var auth Authenticator
+	method := byte(MethodNoAcceptable)
+	for _, a := range auths {
+		for _, m := range buf[:nmethods] {
+			if m == a.Method() {
+				auth, method = a, m
+				break
+			}
+		}
+		if auth != nil {
+			break
+		}
 	}
 	// write VER METHOD
-	if _, err := rw.Write([]byte{5, 0}); err != nil {
-		return nil, err
+	if _, err := rw.Write([]byte{5, method}); err != nil {
+		return "", err
+	}
+	if auth == nil {
+		return "", ErrAuthFailed
+	}
+	return auth.Authenticate(rw)
+}
+
+// authenticate performs RFC 1929 username/password authentication.
+func authenticate(rw io.ReadWriter, creds Credentials) (string, error) {
+	buf := make([]byte, 1+255) // a field and the length of the next
+	// read VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 1 {
+		return "", ErrAuthFailed
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen+1]); err != nil {
+		return "", err
+	}
+	user := string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return "", err
 	}
+	password := string(buf[:plen])
+
+	// write VER STATUS
+	if !creds.Valid(user, password) {
+		rw.Write([]byte{1, 1})
+		return "", ErrAuthFailed
+	}
+	if _, err := rw.Write([]byte{1, 0}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// readRequest reads the request into buf. Returns the command and target address.
+func readRequest(rw io.Reader, buf []byte) (byte, Addr, error) {
+	// Read RFC 1928 for request and reply structure and sizes.
 	// read VER CMD RSV ATYP DST.ADDR DST.PORT
 	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	cmd := buf[1]
 	addr, err := readAddr(rw, buf)
+	return cmd, addr, err
+}
+
+// Refuse reads a SOCKS request from rw and replies with rep instead of serving it.
+// Any credentials offered are accepted unchecked.
+func Refuse(rw io.ReadWriter, rep Error) error {
+	buf := make([]byte, MaxAddrLen)
+	if _, err := negotiate(rw, buf, []Authenticator{NoAuth{}, UserPassAuth{anyCredentials{}}}); err != nil {
+		return err
+	}
+	if _, _, err := readRequest(rw, buf); err != nil {
+		return err
+	}
+	_, err := rw.Write([]byte{5, byte(rep), 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Reply writes a SOCKS5 reply to w with bound address bnd, or 0.0.0.0:0 if nil.
+// The reply is succeeded if err is nil, the SOCKS error if err is one, and a
+// general failure otherwise.
+func Reply(w io.Writer, err error, bnd Addr) error {
+	rep := byte(0)
+	if err != nil {
+		rep = byte(ErrGeneralFailure)
+		if e, ok := err.(Error); ok {
+			rep = byte(e)
+		}
+	}
+	if bnd == nil {
+		bnd = Addr{AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	_, err = w.Write(append([]byte{5, rep, 0}, bnd...))
+	return err
+}
+
+// Handshake fast-tracks SOCKS initialization to get target address to connect.
+// CONNECT requests are replied to at once, as are UDP ASSOCIATE requests if
+// UDPEnabled, flagged with InfoUDPAssociate. See Server for finer control.
+func Handshake(rw io.ReadWriter) (Addr, error) {
+	c, ok := rw.(net.Conn)
+	if !ok {
+		c = rwConn{ReadWriter: rw}
+	}
+	req, err := (&Server{}).Handshake(c)
 	if err != nil {
 		return nil, err
 	}
-	switch cmd {
-	case CmdConnect:
-		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
-	case CmdUDPAssociate:
-		if !UDPEnabled {
-			return nil, ErrCommandNotSupported
-		}
-		listenAddr := ParseAddr(rw.(net.Conn).LocalAddr().String())
-		_, err = rw.Write(append([]byte{5, 0, 0}, listenAddr...)) // SOCKS v5, reply succeeded
-		if err != nil {
-			return nil, ErrCommandNotSupported
+	switch {
+	case req.Command == CmdConnect:
+		return req.Addr, req.Reply(nil, nil)
+	case req.Command == CmdUDPAssociate && UDPEnabled:
+		if err := req.Reply(nil, ParseAddr(c.LocalAddr().String())); err != nil {
+			return nil, err
 		}
-		err = InfoUDPAssociate
-	default:
-		return nil, ErrCommandNotSupported
+		return req.Addr, InfoUDPAssociate
 	}
+	req.Reply(ErrCommandNotSupported, nil)
+	return nil, ErrCommandNotSupported
+}
 
-	return addr, err // skip VER, CMD, RSV fields
+// rwConn reads and writes a bare io.ReadWriter as a net.Conn without
+// addresses or deadlines.
+type rwConn struct {
+	io.ReadWriter
+	net.Conn
 }
+
+func (c rwConn) Read(b []byte) (int, error)  { return c.ReadWriter.Read(b) }
+func (c rwConn) Write(b []byte) (int, error) { return c.ReadWriter.Write(b) }
@@ -0,0 +1,128 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+)
+
+// maxSocks4Field is the maximum length of the USERID and SOCKS4a domain fields.
+const maxSocks4Field = 255
+
+var errSocks4FieldTooLong = errors.New("SOCKS4 field too long")
+
+// readRequest4 reads a SOCKS4 or SOCKS4a request from r. Returns the command
+// and target address.
+func readRequest4(r io.Reader) (byte, Addr, error) {
+	// read VN CD DSTPORT DSTIP
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != 4 {
+		return 0, nil, errors.New("not a SOCKS4 request")
+	}
+	cmd, port, ip := buf[1], buf[2:4], buf[4:8]
+
+	// USERID is ignored
+	if _, err := readNullTerminated(r); err != nil {
+		return 0, nil, err
+	}
+
+	var addr Addr
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 { // SOCKS4a: domain follows
+		host, err := readNullTerminated(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(host) == 0 {
+			return cmd, nil, ErrAddressNotSupported
+		}
+		addr = make([]byte, 1+1+len(host)+2)
+		addr[0] = AtypDomainName
+		addr[1] = byte(len(host))
+		copy(addr[2:], host)
+	} else {
+		addr = make([]byte, 1+net.IPv4len+2)
+		addr[0] = AtypIPv4
+		copy(addr[1:], ip)
+	}
+	copy(addr[len(addr)-2:], port)
+	return cmd, addr, nil
+}
+
+// reply4 writes a SOCKS4 reply with code rep.
+func reply4(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{0, rep, 0, 0, 0, 0, 0, 0}) // VN, CD, DSTPORT and DSTIP ignored
+	return err
+}
+
+// Handshake4 reads a SOCKS4 or SOCKS4a CONNECT request from rw, replies
+// granted (0x5A) and returns the target address. Other commands and malformed
+// targets are rejected (0x5B).
+func Handshake4(rw io.ReadWriter) (Addr, error) {
+	addr, err := ReadRequest4(rw)
+	if err != nil {
+		return nil, err
+	}
+	return addr, Reply4(rw, nil)
+}
+
+// ReadRequest4 is like Handshake4 but leaves the reply to a valid request to
+// the caller, see Reply4.
+func ReadRequest4(rw io.ReadWriter) (Addr, error) {
+	cmd, addr, err := readRequest4(rw)
+	if err == ErrAddressNotSupported {
+		reply4(rw, socks4Rejected)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cmd != CmdConnect {
+		reply4(rw, socks4Rejected)
+		return nil, ErrCommandNotSupported
+	}
+	return addr, nil
+}
+
+// Reply4 writes a SOCKS4 reply to w, granted (0x5A) if err is nil and
+// rejected (0x5B) otherwise.
+func Reply4(w io.Writer, err error) error {
+	if err != nil {
+		return reply4(w, socks4Rejected)
+	}
+	return reply4(w, socks4Granted)
+}
+
+// Refuse4 reads a SOCKS4 or SOCKS4a request from rw and rejects it (0x5B).
+func Refuse4(rw io.ReadWriter) error {
+	if _, _, err := readRequest4(rw); err != nil && err != ErrAddressNotSupported {
+		return err
+	}
+	return reply4(rw, socks4Rejected)
+}
+
+// readNullTerminated reads a NUL-terminated field of SOCKS4 requests.
+func readNullTerminated(r io.Reader) ([]byte, error) {
+	var b []byte
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return nil, err
+		}
+		if c[0] == 0 {
+			return b, nil
+		}
+		if len(b) == maxSocks4Field {
+			return nil, errSocks4FieldTooLong
+		}
+		b = append(b, c[0])
+	}
+}
@@ -0,0 +1,60 @@
+package socks
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// bufConn reads a request from its Reader and collects replies in w.
+type bufConn struct {
+	*bytes.Reader
+	w bytes.Buffer
+}
+
+func (b *bufConn) Write(p []byte) (int, error) { return b.w.Write(p) }
+
+func TestHandshake4(t *testing.T) {
+	long := strings.Repeat("a", maxSocks4Field+1)
+	tests := []struct {
+		name  string
+		req   string
+		addr  string // empty if rejected
+		reply byte   // 0 if none
+	}{
+		{"SOCKS4", "\x04\x01\x00\x50\x01\x02\x03\x04user\x00", "1.2.3.4:80", socks4Granted},
+		{"SOCKS4a", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00example.com\x00", "example.com:443", socks4Granted},
+		{"SOCKS4a empty domain", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00\x00", "", socks4Rejected},
+		{"BIND", "\x04\x02\x00\x50\x01\x02\x03\x04\x00", "", socks4Rejected},
+		{"SOCKS5", "\x05\x01\x00", "", 0},
+		{"long user ID", "\x04\x01\x00\x50\x01\x02\x03\x04" + long + "\x00", "", 0},
+		{"long domain", "\x04\x01\x00\x50\x00\x00\x00\x01\x00" + long + "\x00", "", 0},
+		{"truncated", "\x04\x01\x00\x50\x01\x02\x03\x04user", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &bufConn{Reader: bytes.NewReader([]byte(tt.req))}
+			addr, err := Handshake4(c)
+			if tt.addr != "" && (err != nil || addr.String() != tt.addr) {
+				t.Errorf("got %x, %v; want %s", []byte(addr), err, tt.addr)
+			}
+			if tt.addr == "" && err == nil {
+				t.Errorf("got %x, want error", []byte(addr))
+			}
+			var want []byte
+			if tt.reply != 0 {
+				want = []byte{0, tt.reply, 0, 0, 0, 0, 0, 0}
+			}
+			if !bytes.Equal(c.w.Bytes(), want) {
+				t.Errorf("replied %x, want %x", c.w.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestRefuse4(t *testing.T) {
+	c := &bufConn{Reader: bytes.NewReader([]byte("\x04\x01\x01\xbb\x00\x00\x00\x01\x00example.com\x00"))}
+	if err := Refuse4(c); err != nil || !bytes.Equal(c.w.Bytes(), []byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("replied %x, %v", c.w.Bytes(), err)
+	}
+}
@@ -0,0 +1,92 @@
+package socks
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMalformedDatagram means that a SOCKS UDP request header is invalid.
+var ErrMalformedDatagram = errors.New("malformed SOCKS UDP datagram")
+
+// ParseDatagram splits a SOCKS UDP request datagram as defined in RFC 1928
+// section 7 into its FRAG field, target address and data.
+func ParseDatagram(b []byte) (frag byte, addr Addr, data []byte, err error) {
+	// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA
+	if len(b) < 3 || b[0] != 0 || b[1] != 0 {
+		return 0, nil, nil, ErrMalformedDatagram
+	}
+	addr = SplitAddr(b[3:])
+	if addr == nil {
+		return 0, nil, nil, ErrMalformedDatagram
+	}
+	return b[2], addr, b[3+len(addr):], nil
+}
+
+// fragEnd marks the last fragment of a sequence in the FRAG field.
+const fragEnd = 0x80
+
+// Reassembler reassembles the fragmented UDP datagrams of a single client as
+// described in RFC 1928 section 7. Fragments must arrive in order; a gap, a
+// lower position, a standalone datagram or an expired timer abandons the
+// pending sequence. A fragment at position 1 starts a new sequence.
+type Reassembler struct {
+	timeout time.Duration
+	maxSize int
+
+	addr   Addr
+	data   []byte
+	last   byte // position of the latest queued fragment, 0 if none
+	expiry time.Time
+}
+
+// NewReassembler returns a Reassembler abandoning sequences not completed
+// within timeout or growing beyond maxSize bytes of data.
+func NewReassembler(timeout time.Duration, maxSize int) *Reassembler {
+	return &Reassembler{timeout: timeout, maxSize: maxSize}
+}
+
+// Add adds a datagram with the given FRAG field, target address and data.
+// Returns the target address and data of a complete datagram, or nils if
+// there is none yet. The returned slices are only valid until the next call.
+func (r *Reassembler) Add(frag byte, addr Addr, data []byte) (Addr, []byte) {
+	now := time.Now()
+	if !r.Pending(now) {
+		r.reset()
+	}
+	if frag == 0 { // standalone datagram
+		r.reset()
+		return addr, data
+	}
+
+	pos := frag &^ fragEnd
+	if pos != r.last+1 {
+		r.reset() // a gap, possibly before the start of a new sequence
+	}
+	if pos != r.last+1 || len(r.data)+len(data) > r.maxSize {
+		r.reset()
+		return nil, nil
+	}
+	if r.last == 0 {
+		r.addr = append(r.addr[:0], addr...)
+		r.expiry = now.Add(r.timeout)
+	}
+	r.data = append(r.data, data...)
+	r.last = pos
+
+	if frag&fragEnd == 0 {
+		return nil, nil
+	}
+	addr, data = r.addr, r.data
+	r.reset()
+	return addr, data
+}
+
+// Pending reports whether a sequence is queued and not expired at now.
+func (r *Reassembler) Pending(now time.Time) bool {
+	return r.last != 0 && now.Before(r.expiry)
+}
+
+func (r *Reassembler) reset() {
+	r.last = 0
+	r.data = r.data[:0]
+}
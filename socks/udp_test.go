@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReassembler(t *testing.T) {
+	a := ParseAddr("1.2.3.4:53")
+	b := ParseAddr("example.com:443")
+	type frag struct {
+		frag byte
+		addr Addr
+		data string
+	}
+	tests := []struct {
+		name  string
+		frags []frag
+		addr  Addr // of the last fragment's result
+		data  string
+	}{
+		{"standalone", []frag{{0, a, "x"}}, a, "x"},
+		{"in order", []frag{{1, a, "ab"}, {2, a, "cd"}, {3 | fragEnd, a, "e"}}, a, "abcde"},
+		{"single end fragment", []frag{{1 | fragEnd, b, "ab"}}, b, "ab"},
+		{"address of the first fragment", []frag{{1, a, "ab"}, {2 | fragEnd, b, "cd"}}, a, "abcd"},
+		{"gap", []frag{{1, a, "ab"}, {3 | fragEnd, a, "cd"}}, nil, ""},
+		{"lower position", []frag{{1, a, "ab"}, {2, a, "cd"}, {2 | fragEnd, a, "ef"}}, nil, ""},
+		{"standalone abandons sequence", []frag{{1, a, "ab"}, {0, b, "x"}, {2 | fragEnd, a, "cd"}}, nil, ""},
+		{"not starting at 1", []frag{{2 | fragEnd, a, "ab"}}, nil, ""},
+		{"position 0 end", []frag{{fragEnd, a, "ab"}}, nil, ""},
+		{"new sequence after lost end", []frag{{1, a, "ab"}, {1, b, "cd"}, {2 | fragEnd, b, "ef"}}, b, "cdef"},
+		{"too large", []frag{{1, a, "abcdef"}, {2 | fragEnd, a, "ghijk"}}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler(time.Minute, 10)
+			var addr Addr
+			var data []byte
+			for _, f := range tt.frags {
+				addr, data = r.Add(f.frag, f.addr, []byte(f.data))
+			}
+			if !bytes.Equal(addr, tt.addr) || string(data) != tt.data {
+				t.Errorf("got %x %q, want %x %q", []byte(addr), data, []byte(tt.addr), tt.data)
+			}
+		})
+	}
+}
+
+func TestReassemblerExpiry(t *testing.T) {
+	a := ParseAddr("1.2.3.4:53")
+	r := NewReassembler(10*time.Millisecond, 1024)
+	r.Add(1, a, []byte("ab"))
+	if !r.Pending(time.Now()) {
+		t.Fatal("sequence not pending")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if r.Pending(time.Now()) {
+		t.Fatal("expired sequence still pending")
+	}
+	if addr, data := r.Add(2|fragEnd, a, []byte("cd")); addr != nil || data != nil {
+		t.Errorf("completed expired sequence: %x %q", []byte(addr), data)
+	}
+}
+
+func TestParseDatagram(t *testing.T) {
+	addr := ParseAddr("1.2.3.4:53")
+	frag, a, data, err := ParseDatagram(append(append([]byte{0, 0, 2}, addr...), "payload"...))
+	if err != nil || frag != 2 || !bytes.Equal(a, addr) || string(data) != "payload" {
+		t.Errorf("got %d %x %q %v", frag, []byte(a), data, err)
+	}
+	for _, b := range [][]byte{nil, {0, 0}, {1, 0, 0, 1, 1, 2, 3, 4, 0, 53}, {0, 0, 0, 1, 1, 2}} {
+		if _, _, _, err := ParseDatagram(b); err != ErrMalformedDatagram {
+			t.Errorf("ParseDatagram(%v): got %v, want ErrMalformedDatagram", b, err)
+		}
+	}
+}
@@ -1,17 +1,107 @@
 package main
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/shadowsocks/go-shadowsocks2/internal/netutil"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
+// refuseTimeout bounds how long a refused client may take to read the refusal.
+const refuseTimeout = 5 * time.Second
+
+// handshakeTimeout bounds how long a proxy client may take to get through the
+// handshake, from its first byte to its request.
+var handshakeTimeout = 30 * time.Second
+
 // Create a SOCKS server listening on addr and proxy to server.
 func socksLocal(addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("SOCKS proxy %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) })
+	tcpLocal(addr, server, shadow, sniffing(socksHandshake), refuseSocks)
+}
+
+// socksHandshake performs the SOCKS5 or SOCKS4 handshake depending on the
+// version the client speaks.
+func socksHandshake(c net.Conn, sess *session) (net.Conn, socks.Addr, error) {
+	ver, c, err := peekVersion(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ver == 4 {
+		return socks4Handshake(c, sess)
+	}
+	return socks5Handshake(c, sess)
+}
+
+// socks5Handshake performs the SOCKS5 handshake, authenticating the client if
+// credentials are configured. Requests not replied to right away are flagged
+// with the socks.Info error telling how to carry on.
+func socks5Handshake(c net.Conn, sess *session) (net.Conn, socks.Addr, error) {
+	var srv socks.Server // the deadline is set by serveLocal
+	if config.Credentials != nil {
+		srv.Authenticators = []socks.Authenticator{socks.UserPassAuth{Credentials: config.Credentials}}
+	}
+	req, err := srv.Handshake(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	sess.User = req.User
+	if !sess.Admit() {
+		req.Reply(socks.ErrConnectionNotAllowed, nil)
+		return nil, nil, errUserLimit
+	}
+
+	switch {
+	case req.Command == socks.CmdConnect && config.DeferReply != "":
+		return c, req.Addr, socks.InfoConnect // see connectReply
+	case req.Command == socks.CmdConnect:
+		return c, req.Addr, req.Reply(nil, nil)
+	case req.Command == socks.CmdUDPAssociate && config.UDPSocks:
+		if err := req.Reply(nil, socks.ParseAddr(c.LocalAddr().String())); err != nil {
+			return nil, nil, err
+		}
+		return c, req.Addr, socks.InfoUDPAssociate
+	case req.Command == socks.CmdBind && config.Bind:
+		return c, req.Addr, socks.InfoBind // see bindReplies
+	}
+	req.Reply(socks.ErrCommandNotSupported, nil)
+	return nil, nil, socks.ErrCommandNotSupported
+}
+
+// socks4Handshake performs the SOCKS4/4a handshake. Clients are rejected if
+// credentials are configured, as SOCKS4 cannot authenticate.
+func socks4Handshake(c net.Conn, sess *session) (net.Conn, socks.Addr, error) {
+	if config.Credentials != nil {
+		socks.Refuse4(c)
+		return nil, nil, errors.New("SOCKS4 cannot authenticate")
+	}
+	tgt, err := socks.ReadRequest4(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sess.Admit() {
+		socks.Reply4(c, errUserLimit)
+		return nil, nil, errUserLimit
+	}
+	return c, tgt, socks.Reply4(c, nil)
+}
+
+// Tell a SOCKS client that it is over the connection limits.
+func refuseSocks(c net.Conn) {
+	ver, c, err := peekVersion(c)
+	if err != nil {
+		return
+	}
+	if ver == 4 {
+		socks.Refuse4(c)
+		return
+	}
+	socks.Refuse(c, socks.ErrConnectionNotAllowed)
 }
 
 // Create a TCP tunnel from addr to target via server.
@@ -22,123 +112,279 @@ func tcpTun(addr, server, target string, shadow func(net.Conn) net.Conn) {
 		return
 	}
 	logf("TCP tunnel %s <-> %s <-> %s", addr, server, target)
-	tcpLocal(addr, server, shadow, func(net.Conn) (socks.Addr, error) { return tgt, nil })
+	tcpLocal(addr, server, shadow, addrOnly(func(net.Conn) (socks.Addr, error) { return tgt, nil }), nil)
 }
 
-// Listen on addr and proxy to server to reach target from getAddr.
-func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
+// A handshake reads the target address from a newly accepted client connection
+// c, filling in what it learns about the client in sess. It returns the
+// connection to relay from, which may wrap c to replay bytes consumed or
+// rewritten during the handshake.
+type handshake func(c net.Conn, sess *session) (net.Conn, socks.Addr, error)
+
+// addrOnly adapts getAddr which consumes nothing beyond the handshake from c.
+func addrOnly(getAddr func(net.Conn) (socks.Addr, error)) handshake {
+	return func(c net.Conn, _ *session) (net.Conn, socks.Addr, error) {
+		tgt, err := getAddr(c)
+		return c, tgt, err
+	}
+}
+
+// Listen on addr and proxy to server to reach target from getAddr. Connections
+// over the limits are handed to refuse if not nil, and closed.
+func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr handshake, refuse func(net.Conn)) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", addr, err)
 		return
 	}
+	serveLocal(l, addr, server, shadow, getAddr, refuse)
+}
 
+// Accept connections from l listening on addr and proxy them like tcpLocal.
+func serveLocal(l net.Listener, addr, server string, shadow func(net.Conn) net.Conn, getAddr handshake, refuse func(net.Conn)) {
+	var backoff acceptBackoff
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			logf("failed to accept: %s", err)
+			backoff.Wait()
+			continue
+		}
+		backoff.Reset()
+
+		release, ok := config.ConnLimit.Acquire(c, "") // the user is known after the handshake
+		if !ok {
+			logf("connection limit reached, refusing %s", c.RemoteAddr())
+			go func() {
+				defer c.Close()
+				if refuse != nil {
+					c.SetDeadline(time.Now().Add(refuseTimeout))
+					refuse(c)
+				}
+			}()
 			continue
 		}
 
 		go func() {
+			defer release()
 			defer c.Close()
 			c.(*net.TCPConn).SetKeepAlive(true)
-			tgt, err := getAddr(c)
-			if err != nil {
+			sess := newSession("tcp", c.RemoteAddr())
+			var releaseUser func()
+			sess.admit, releaseUser = config.ConnLimit.Admission(sess, addr)
+			defer releaseUser()
+			c.SetDeadline(time.Now().Add(handshakeTimeout))
+			hc, tgt, err := getAddr(c, sess)
+			c.SetDeadline(time.Time{})
+			bind := err == socks.InfoBind
+			deferred := err == socks.InfoConnect
+			if err != nil && !bind && !deferred {
 
-				// UDP: keep the connection until disconnect then free the UDP socket
+				// UDP: keep the association until disconnect then free the UDP session
 				if err == socks.InfoUDPAssociate {
-					buf := []byte{}
-					// block here
-					for {
-						_, err := c.Read(buf)
-						if err, ok := err.(net.Error); ok && err.Timeout() {
-							continue
-						}
-						logf("UDP Associate End.")
-						return
-					}
+					assocs := associationsOf(addr)
+					a := assocs.Register(c, tgt)
+					defer assocs.Remove(a)
+					io.Copy(ioutil.Discard, c) // block here
+					logf("UDP Associate End.")
+					return
 				}
 
 				logf("failed to get target address: %v", err)
 				return
 			}
+			c = hc // may replay bytes consumed by the handshake
+			sess.Target = tgt.String()
 
-			rc, err := net.Dial("tcp", server)
+			if !sess.Admit() { // the handshake could not tell the client
+				logf("connection limit of %s reached, refusing %s", limitKey(sess.User, addr), c.RemoteAddr())
+				return
+			}
+
+			server, shadow := server, shadow
+			if u, ok := config.Routes.Lookup(sess.User); ok {
+				server, shadow = u.Server, u.Cipher.StreamConn
+			}
+
+			rc, err := dialServer(server)
 			if err != nil {
+				if deferred {
+					socks.Reply(c, replyError(err), nil)
+				}
 				logf("failed to connect to server %v: %v", server, err)
+				sess.Log(closeReason(err))
 				return
 			}
 			defer rc.Close()
-			rc.(*net.TCPConn).SetKeepAlive(true)
+			if tc, ok := rc.(*net.TCPConn); ok { // not through config.Via
+				tc.SetKeepAlive(true)
+			}
 			rc = shadow(rc)
 
-			if _, err = rc.Write(tgt); err != nil {
+			remote := deferred && config.DeferReply == deferToTarget
+			hdr := []byte(tgt)
+			if bind {
+				hdr = bindRequest(tgt)
+			} else if remote {
+				hdr = replyRequest(tgt)
+			} else if config.TCPFastOpen && !deferred {
+				hdr = readInitialPayload(c, tgt)
+			}
+			if _, err = rc.Write(hdr); err != nil {
+				if deferred {
+					socks.Reply(c, replyError(err), nil)
+				}
 				logf("failed to send target address: %v", err)
 				return
 			}
+			if bind {
+				if err := bindReplies(c, rc); err != nil {
+					logf("failed to bind: %v", err)
+					sess.Log(closeReason(err))
+					return
+				}
+			}
+			if deferred {
+				if err := connectReply(c, rc, remote); err != nil {
+					logf("failed to connect to target: %v", err)
+					sess.Log(closeReason(err))
+					return
+				}
+			}
+
+			if rl := config.RateLimit; rl != nil {
+				f := rl.Flow(limitKey(sess.User, addr))
+				defer f.Close()
+				c = &limitedConn{c, f, dirUp}
+				rc = &limitedConn{rc, f, dirDown}
+			}
 
 			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
-			_, _, err = relay(rc, c)
+			sess.Up, sess.Down, err = relay(rc, c)
+			sess.Up += int64(len(hdr) - len(tgt))
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				err = nil // ignore i/o timeout
+			}
 			if err != nil {
-				if err, ok := err.(net.Error); ok && err.Timeout() {
-					return // ignore i/o timeout
-				}
 				logf("relay error: %v", err)
 			}
+			sess.Log(closeReason(err))
 		}()
 	}
 }
 
+// initialPayloadWait is how long to wait for the first client data to send
+// along with the target address in the TCP Fast Open SYN.
+const initialPayloadWait = 50 * time.Millisecond
+
+// readInitialPayload appends to tgt whatever c sends within initialPayloadWait.
+func readInitialPayload(c net.Conn, tgt socks.Addr) []byte {
+	buf := make([]byte, len(tgt), len(tgt)+16*1024)
+	copy(buf, tgt)
+	c.SetReadDeadline(time.Now().Add(initialPayloadWait))
+	n, _ := c.Read(buf[len(tgt):cap(buf)])
+	c.SetReadDeadline(time.Time{})
+	return buf[:len(tgt)+n]
+}
+
 // Listen on addr for incoming connections.
 func tcpRemote(addr string, shadow func(net.Conn) net.Conn) {
-	l, err := net.Listen("tcp", addr)
+	l, err := listenTCP(addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", addr, err)
 		return
 	}
 
 	logf("listening TCP on %s", addr)
+	var backoff acceptBackoff
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			logf("failed to accept: %v", err)
+			backoff.Wait()
+			continue
+		}
+		backoff.Reset()
+
+		release, ok := config.ConnLimit.Acquire(c, limitKey("", addr))
+		if !ok {
+			logf("connection limit reached, refusing %s", c.RemoteAddr())
+			c.Close()
 			continue
 		}
 
 		go func() {
+			defer release()
 			defer c.Close()
 			c.(*net.TCPConn).SetKeepAlive(true)
+			sess := newSession("tcp", c.RemoteAddr())
+			sess.User = limitKey("", addr) // users of the server are told apart by port
 			c = shadow(c)
 
-			tgt, err := socks.ReadAddr(c)
+			tgt, flags, err := readTarget(c)
 			if err != nil {
 				logf("failed to get target address: %v", err)
 				return
 			}
+			sess.Target = tgt.String()
 
-			rc, err := net.Dial("tcp", tgt.String())
+			var rc net.Conn
+			bind := flags&bindFlag != 0
+			if bind && !config.Bind {
+				err = errBindNotAllowed
+			} else if bind {
+				rc, err = bindRemote(c, tgt)
+			} else {
+				rc, err = config.Outbounds.Select(sess.User, tgt).Dial(tgt)
+				if flags&replyFlag != 0 {
+					if rerr := replyRemote(c, rc, err); err == nil && rerr != nil {
+						rc.Close()
+						err = rerr
+					}
+				}
+			}
 			if err != nil {
 				logf("failed to connect to target: %v", err)
+				sess.Log(closeReason(err))
 				return
 			}
 			defer rc.Close()
-			rc.(*net.TCPConn).SetKeepAlive(true)
+			if tc, ok := rc.(*net.TCPConn); ok { // connected directly
+				tc.SetKeepAlive(true)
+				sess.Resolved = rc.RemoteAddr()
+			}
+
+			if rl := config.RateLimit; rl != nil {
+				f := rl.Flow(limitKey(sess.User, addr))
+				defer f.Close()
+				c = &limitedConn{c, f, dirUp}
+				rc = &limitedConn{rc, f, dirDown}
+			}
 
 			logf("proxy %s <-> %s", c.RemoteAddr(), tgt)
-			_, _, err = relay(c, rc)
+			sess.Down, sess.Up, err = relay(c, rc)
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				err = nil // ignore i/o timeout
+			}
 			if err != nil {
-				if err, ok := err.(net.Error); ok && err.Timeout() {
-					return // ignore i/o timeout
-				}
 				logf("relay error: %v", err)
 			}
+			sess.Log(closeReason(err))
 		}()
 	}
 }
 
+// Errors reported by relay when a relay is cut short by configured timeouts.
+var (
+	errIdleTimeout = errors.New("idle timeout")
+	errMaxLifetime = errors.New("maximum lifetime reached")
+)
+
 // relay copies between left and right bidirectionally. Returns number of
 // bytes copied from right to left, from left to right, and any error occurred.
+// When one direction reaches EOF, the write side of its destination is shut
+// down and the other direction keeps going until it ends too. The relay is
+// aborted with errIdleTimeout or errMaxLifetime if configured.
 func relay(left, right net.Conn) (int64, int64, error) {
 	type res struct {
 		N   int64
@@ -146,20 +392,121 @@ func relay(left, right net.Conn) (int64, int64, error) {
 	}
 	ch := make(chan res)
 
+	var w *watchdog
+	if config.IdleTimeout > 0 || config.MaxLifetime > 0 {
+		w = newWatchdog(left, right)
+		left, right = w.Track(left), w.Track(right)
+	}
+
 	go func() {
 		n, err := io.Copy(right, left)
-		right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
-		left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
+		if err != nil || netutil.CloseWrite(right) != nil {
+			right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
+			left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
+		}
 		ch <- res{n, err}
 	}()
 
 	n, err := io.Copy(left, right)
-	right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
-	left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
+	if err != nil || netutil.CloseWrite(left) != nil {
+		right.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
+		left.SetDeadline(time.Now())  // wake up the other goroutine blocking on left
+	}
 	rs := <-ch
 
 	if err == nil {
 		err = rs.Err
 	}
+	if w != nil {
+		if werr := w.Stop(); werr != nil {
+			err = werr
+		}
+	}
 	return n, rs.N, err
 }
+
+// watchdog aborts a relay that has been idle for config.IdleTimeout or alive
+// for longer than config.MaxLifetime by expiring the deadlines of both sides.
+type watchdog struct {
+	last   int64 // UnixNano of the latest read on either side
+	stop   chan struct{}
+	done   chan struct{}
+	err    error // set before done is closed
+	expire func()
+}
+
+func newWatchdog(left, right net.Conn) *watchdog {
+	w := &watchdog{
+		last: time.Now().UnixNano(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		expire: func() {
+			right.SetDeadline(time.Now())
+			left.SetDeadline(time.Now())
+		},
+	}
+	go w.run()
+	return w
+}
+
+func (w *watchdog) run() {
+	defer close(w.done)
+
+	var lifetime, idle <-chan time.Time
+	if config.MaxLifetime > 0 {
+		t := time.NewTimer(config.MaxLifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+	var idleTimer *time.Timer
+	if config.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-lifetime:
+			w.err = errMaxLifetime
+			w.expire()
+			return
+		case <-idle:
+			last := time.Unix(0, atomic.LoadInt64(&w.last))
+			if d := time.Until(last.Add(config.IdleTimeout)); d > 0 {
+				idleTimer.Reset(d)
+				continue
+			}
+			w.err = errIdleTimeout
+			w.expire()
+			return
+		}
+	}
+}
+
+// Stop stops the watchdog and returns the timeout that fired, if any.
+func (w *watchdog) Stop() error {
+	close(w.stop)
+	<-w.done
+	return w.err
+}
+
+// Track wraps c so that reads from it count as activity.
+func (w *watchdog) Track(c net.Conn) net.Conn { return &activityConn{c, &w.last} }
+
+type activityConn struct {
+	net.Conn
+	last *int64
+}
+
+func (c *activityConn) CloseWrite() error { return netutil.CloseWrite(c.Conn) }
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
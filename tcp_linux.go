@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net"
 	"syscall"
@@ -12,18 +13,71 @@ import (
 const (
 	SO_ORIGINAL_DST      = 80 // from linux/include/uapi/linux/netfilter_ipv4.h
 	IP6T_SO_ORIGINAL_DST = 80 // from linux/include/uapi/linux/netfilter_ipv6/ip6_tables.h
+	TCP_FASTOPEN         = 23 // from linux/include/uapi/linux/tcp.h
+	TCP_FASTOPEN_CONNECT = 30 // from linux/include/uapi/linux/tcp.h, since Linux 4.11
 )
 
+// tfoQueueLen is the maximum number of pending TCP Fast Open requests.
+const tfoQueueLen = 256
+
+// Listen for TCP on addr, with TCP Fast Open if enabled.
+func listenTCP(addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if config.TCPFastOpen {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return setsockoptInt(c, syscall.IPPROTO_TCP, TCP_FASTOPEN, tfoQueueLen)
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// Dial addr over TCP. With TCP Fast Open enabled, the handshake is deferred
+// until the first write, whose data goes out in the SYN.
+func dialTCP(addr string) (net.Conn, error) {
+	var d net.Dialer
+	if config.TCPFastOpen {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			return setsockoptInt(c, syscall.IPPROTO_TCP, TCP_FASTOPEN_CONNECT, 1)
+		}
+	}
+	return d.Dial("tcp", addr)
+}
+
+// Set an integer socket option. Failures are logged but not fatal so that
+// older kernels simply go without the option.
+func setsockoptInt(c syscall.RawConn, level, opt, value int) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) { err = syscall.SetsockoptInt(int(fd), level, opt, value) }); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		logf("failed to set socket option %d: %v", opt, err)
+	}
+	return nil
+}
+
 // Listen on addr for netfilter redirected TCP connections
 func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("TCP redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) })
+	tcpLocal(addr, server, shadow, sniffing(addrOnly(func(c net.Conn) (socks.Addr, error) {
+		tgt, err := getOrigDst(c, false)
+		if err != nil {
+			return nil, err
+		}
+		return config.FakeIP.Target(tgt)
+	})), nil)
 }
 
 // Listen on addr for netfilter redirected TCP IPv6 connections.
 func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("TCP6 redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) })
+	tcpLocal(addr, server, shadow, sniffing(addrOnly(func(c net.Conn) (socks.Addr, error) {
+		tgt, err := getOrigDst(c, true)
+		if err != nil {
+			return nil, err
+		}
+		return config.FakeIP.Target(tgt)
+	})), nil)
 }
 
 // Get the original destination of a TCP connection.
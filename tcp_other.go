@@ -11,3 +11,12 @@ func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
 func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
 	logf("TCP6 redirect not supported")
 }
+
+func listenTCP(addr string) (net.Listener, error) {
+	if config.TCPFastOpen {
+		logf("TCP Fast Open not supported")
+	}
+	return net.Listen("tcp", addr)
+}
+
+func dialTCP(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
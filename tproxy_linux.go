@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	IP_TRANSPARENT       = 19 // from linux/include/uapi/linux/in.h
+	IP_RECVORIGDSTADDR   = 20 // from linux/include/uapi/linux/in.h
+	IPV6_TRANSPARENT     = 75 // from linux/include/uapi/linux/in6.h
+	IPV6_RECVORIGDSTADDR = 74 // from linux/include/uapi/linux/in6.h
+)
+
+// Listen on addr for TCP connections diverted by a netfilter TPROXY rule.
+func tproxyLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	logf("TCP tproxy %s <-> %s", addr, server)
+	serveLocal(l, addr, server, shadow, sniffing(addrOnly(func(c net.Conn) (socks.Addr, error) {
+		// With TPROXY the local address is the original destination.
+		if tgt := socks.ParseAddr(c.LocalAddr().String()); tgt != nil {
+			return config.FakeIP.Target(tgt)
+		}
+		return nil, errors.New("invalid original destination")
+	})), nil)
+}
+
+// Listen on laddr for UDP packets diverted by a netfilter TPROXY rule, encrypt
+// and send to server to reach their original destinations.
+func udpTproxyLocal(laddr, server string, shadow func(net.PacketConn) net.PacketConn) {
+	srvAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		logf("UDP server address error: %v", err)
+		return
+	}
+
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	lpc, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
+		logf("UDP local listen error: %v", err)
+		return
+	}
+	c := lpc.(*net.UDPConn)
+	defer c.Close()
+
+	nm := newNATmap(config.UDPTimeout)
+	buf := make([]byte, udpBufSize)
+	oob := make([]byte, 1024)
+
+	logf("UDP tproxy %s <-> %s", laddr, server)
+	for {
+		// leave room in front of the payload for the target address
+		n, oobn, _, raddr, err := c.ReadMsgUDP(buf[socks.MaxAddrLen:], oob)
+		if err != nil {
+			logf("UDP local read error: %v", err)
+			continue
+		}
+
+		tgt, err := origDstFromOOB(oob[:oobn])
+		if err != nil {
+			logf("failed to get original destination: %v", err)
+			continue
+		}
+		pkt := buf[socks.MaxAddrLen-len(tgt) : socks.MaxAddrLen+n]
+		copy(pkt, tgt)
+
+		pc := nm.Get(raddr.String())
+		if pc == nil {
+			pc, err = listenServer()
+			if err != nil {
+				logf("UDP local listen error: %v", err)
+				continue
+			}
+
+			sess := newSession("udp", raddr)
+			sess.Target = tgt.String()
+			if dst, err := config.FakeIP.Target(tgt); err == nil {
+				sess.Target = dst.String()
+			}
+			pc = natConn(shadow(pc), sess, laddr)
+			if config.Sniff {
+				pc = newSniffPacketConn(pc)
+			}
+			if config.FakeIP != nil {
+				pc = &fakeIPPacketConn{PacketConn: pc, pool: config.FakeIP}
+			}
+			nm.Add(raddr, &tproxyReplier{PacketConn: c}, pc, tproxyClient, sess)
+		}
+
+		_, err = pc.WriteTo(pkt, srvAddr)
+		if err != nil {
+			logf("UDP local write error: %v", err)
+			continue
+		}
+	}
+}
+
+// Returns a Control function making a socket transparent, and for UDP also
+// making it report the original destination of received packets.
+func transparentControl(udp bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+			if err == nil && udp {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_RECVORIGDSTADDR, 1)
+			}
+			if err == nil && network != "tcp4" && network != "udp4" {
+				// best effort on IPv6 sockets; fails harmlessly on IPv4 ones
+				if syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1) == nil && udp {
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1)
+				}
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// Extract the original destination from IP_ORIGDSTADDR or IPV6_ORIGDSTADDR
+// control messages.
+func origDstFromOOB(oob []byte) (socks.Addr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == IP_RECVORIGDSTADDR && len(m.Data) >= 8:
+			// struct sockaddr_in: family, port (big-endian), address
+			addr := make([]byte, 1+net.IPv4len+2)
+			addr[0] = socks.AtypIPv4
+			copy(addr[1:], m.Data[4:8])
+			addr[1+net.IPv4len], addr[1+net.IPv4len+1] = m.Data[2], m.Data[3]
+			return addr, nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == IPV6_RECVORIGDSTADDR && len(m.Data) >= 24:
+			// struct sockaddr_in6: family, port (big-endian), flowinfo, address
+			addr := make([]byte, 1+net.IPv6len+2)
+			addr[0] = socks.AtypIPv6
+			copy(addr[1:], m.Data[8:24])
+			addr[1+net.IPv6len], addr[1+net.IPv6len+1] = m.Data[2], m.Data[3]
+			return addr, nil
+		}
+	}
+	return nil, errors.New("no original destination in control messages")
+}
+
+// tproxyReplier sends packets prefixed with their source SOCKS address to the
+// client from that very source address, using transparent sockets bound to
+// the foreign address. It belongs to a single NAT session and Close releases
+// only its own sockets.
+type tproxyReplier struct {
+	// the TPROXY listener, for everything but WriteTo and Close
+	net.PacketConn
+	conns map[string]net.PacketConn // by source SOCKS address
+}
+
+func (r *tproxyReplier) WriteTo(b []byte, addr net.Addr) (int, error) {
+	src := socks.SplitAddr(b)
+	if src == nil {
+		return 0, errors.New("missing source address")
+	}
+	pc, ok := r.conns[string(src)]
+	if !ok {
+		host, port, err := net.SplitHostPort(src.String())
+		if err != nil {
+			return 0, err
+		}
+		network := "udp4"
+		if src[0] == socks.AtypIPv6 {
+			network = "udp6"
+		}
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+				if network == "udp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		}}
+		pc, err = lc.ListenPacket(context.Background(), network, net.JoinHostPort(host, port))
+		if err != nil {
+			return 0, err
+		}
+		if r.conns == nil {
+			r.conns = make(map[string]net.PacketConn)
+		}
+		r.conns[string(src)] = pc
+	}
+	n, err := pc.WriteTo(b[len(src):], addr)
+	return n + len(src), err
+}
+
+func (r *tproxyReplier) Close() error {
+	for k, pc := range r.conns {
+		pc.Close()
+		delete(r.conns, k)
+	}
+	return nil
+}
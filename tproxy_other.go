@@ -0,0 +1,13 @@
+// +build !linux
+
+package main
+
+import "net"
+
+func tproxyLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+	logf("TCP tproxy not supported")
+}
+
+func udpTproxyLocal(laddr, server string, shadow func(net.PacketConn) net.PacketConn) {
+	logf("UDP tproxy not supported")
+}
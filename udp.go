@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
 	"sync"
 
+	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
@@ -16,6 +18,7 @@ const (
 	remoteServer mode = iota
 	relayClient
 	socksClient
+	tproxyClient
 )
 
 const udpBufSize = 64 * 1024
@@ -56,14 +59,16 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 
 		pc := nm.Get(raddr.String())
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = listenServer()
 			if err != nil {
 				logf("UDP local listen error: %v", err)
 				continue
 			}
 
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, relayClient)
+			sess := newSession("udp", raddr)
+			sess.Target = target
+			pc = natConn(shadow(pc), sess, laddr)
+			nm.Add(raddr, c, pc, relayClient, sess)
 		}
 
 		_, err = pc.WriteTo(buf[:len(tgt)+n], srvAddr)
@@ -91,6 +96,14 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 
 	nm := newNATmap(config.UDPTimeout)
 	buf := make([]byte, udpBufSize)
+	frags := newFragQueues()
+
+	assocs := associationsOf(laddr)
+	assocs.SetTeardown(func(peer string) {
+		if pc := nm.Del(peer); pc != nil {
+			pc.Close()
+		}
+	})
 
 	for {
 		n, raddr, err := c.ReadFrom(buf)
@@ -99,19 +112,44 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 			continue
 		}
 
+		if !assocs.Allow(raddr) {
+			logf("UDP local: dropping datagram from unassociated %s", raddr)
+			continue
+		}
+
+		frag, tgt, data, err := socks.ParseDatagram(buf[:n])
+		if err != nil {
+			logf("UDP local: dropping datagram from %s: %v", raddr, err)
+			continue
+		}
+		pkt := buf[3:n] // target address and data
+		if frag != 0 {
+			if tgt, data = frags.Get(raddr).Add(frag, tgt, data); tgt == nil {
+				continue // incomplete or abandoned
+			}
+			pkt = append(append(make([]byte, 0, len(tgt)+len(data)), tgt...), data...)
+		} else {
+			frags.Del(raddr) // a standalone datagram abandons any pending sequence
+		}
+
 		pc := nm.Get(raddr.String())
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = listenServer()
 			if err != nil {
 				logf("UDP local listen error: %v", err)
 				continue
 			}
-			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, socks.Addr(buf[3:]))
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, socksClient)
+			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, tgt)
+			sess := newSession("udp", raddr)
+			sess.Target = tgt.String()
+			pc = natConn(shadow(pc), sess, laddr)
+			if config.Sniff {
+				pc = newSniffPacketConn(pc)
+			}
+			nm.Add(raddr, c, pc, socksClient, sess)
 		}
 
-		_, err = pc.WriteTo(buf[3:n], srvAddr)
+		_, err = pc.WriteTo(pkt, srvAddr)
 		if err != nil {
 			logf("UDP local write error: %v", err)
 			continue
@@ -119,6 +157,57 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 	}
 }
 
+// Limits of SOCKS UDP fragment reassembly.
+const (
+	fragTimeout   = 5 * time.Second // RFC 1928 asks for no less than 5 seconds
+	maxFragQueues = 1024            // clients with a pending sequence
+)
+
+// fragQueues holds a SOCKS UDP reassembly queue per client. It is only used
+// by the receiving goroutine.
+type fragQueues map[string]*socks.Reassembler
+
+func newFragQueues() fragQueues { return make(fragQueues) }
+
+// Del drops the queue of peer, if any.
+func (q fragQueues) Del(peer net.Addr) {
+	if len(q) > 0 {
+		delete(q, peer.String())
+	}
+}
+
+// Get returns the queue of peer, creating it if needed. Queues without a
+// pending sequence are dropped when there are too many.
+func (q fragQueues) Get(peer net.Addr) *socks.Reassembler {
+	r, ok := q[peer.String()]
+	if ok {
+		return r
+	}
+	if len(q) >= maxFragQueues {
+		now := time.Now()
+		for k, r := range q {
+			if !r.Pending(now) {
+				delete(q, k)
+			}
+		}
+	}
+	r = socks.NewReassembler(fragTimeout, udpBufSize)
+	if len(q) < maxFragQueues {
+		q[peer.String()] = r
+	}
+	return r
+}
+
+// maxPendingPackets bounds the datagrams of a server NAT session held while it
+// is set up or their targets are looked up.
+const maxPendingPackets = 64
+
+// pendingPacket is a datagram held until it can be forwarded.
+type pendingPacket struct {
+	target  string
+	payload []byte
+}
+
 // Listen on addr for encrypted packets and basically do UDP NAT.
 func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 	c, err := net.ListenPacket("udp", addr)
@@ -132,6 +221,65 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 	nm := newNATmap(config.UDPTimeout)
 	buf := make([]byte, udpBufSize)
 
+	// Setting up NAT sessions and looking up targets may take long, so it is
+	// done off the loop. Datagrams of a session wait in order behind it.
+	var pendingMu sync.Mutex
+	pending := make(map[string][]pendingPacket) // by NAT session key
+
+	// dstAddr returns the address to send to target through ob.
+	dstAddr := func(ob outbound, target string) (net.Addr, error) {
+		if _, direct := ob.(directOutbound); !direct {
+			return core.HostPort(target), nil // resolved upstream
+		}
+		return config.Resolver.ResolveUDPAddr(target)
+	}
+
+	// drain forwards the datagrams pending for the NAT session under key,
+	// creating it for raddr going through ob if needed.
+	drain := func(raddr net.Addr, key string, ob outbound) {
+		for {
+			pendingMu.Lock()
+			q := pending[key]
+			if len(q) == 0 {
+				delete(pending, key)
+				pendingMu.Unlock()
+				return
+			}
+			p := q[0]
+			pending[key] = q[1:]
+			pendingMu.Unlock()
+
+			dst, err := dstAddr(ob, p.target)
+			if err != nil {
+				logf("failed to resolve target UDP address: %v", err)
+				continue
+			}
+			pc := nm.Get(key)
+			if pc == nil {
+				pc, err = ob.ListenPacket()
+				if err != nil {
+					logf("UDP remote listen error: %v", err)
+					pendingMu.Lock()
+					delete(pending, key) // drop the rest rather than fail again
+					pendingMu.Unlock()
+					return
+				}
+
+				sess := newSession("udp", raddr)
+				sess.User = limitKey("", addr) // users of the server are told apart by port
+				sess.Target = p.target
+				if _, ok := dst.(*net.UDPAddr); ok {
+					sess.Resolved = dst
+				}
+				pc = natConn(pc, sess, addr)
+				nm.AddKey(key, raddr, c, pc, remoteServer, sess)
+			}
+			if _, err := pc.WriteTo(p.payload, dst); err != nil {
+				logf("UDP remote write error: %v", err)
+			}
+		}
+	}
+
 	logf("listening UDP on %s", addr)
 	for {
 		n, raddr, err := c.ReadFrom(buf)
@@ -145,34 +293,61 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 			logf("failed to split target address from packet: %q", buf[:n])
 			continue
 		}
+		target := tgtAddr.String()
+		payload := buf[len(tgtAddr):n]
 
-		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
-		if err != nil {
-			logf("failed to resolve target UDP address: %v", err)
-			continue
+		// A client has a NAT session per outbound its targets go through.
+		ob := config.Outbounds.Select(limitKey("", addr), tgtAddr)
+		key := raddr.String()
+		var dst net.Addr // nil if it takes a lookup
+		if _, direct := ob.(directOutbound); direct {
+			host, port, _ := net.SplitHostPort(target)
+			if ips, ok := config.Resolver.Cached(host); ok {
+				if a, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port)); err == nil {
+					dst = a
+				}
+			}
+		} else {
+			key += " " + ob.String()
+			dst = core.HostPort(target)
 		}
 
-		payload := buf[len(tgtAddr):n]
-
-		pc := nm.Get(raddr.String())
-		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
-			if err != nil {
-				logf("UDP remote listen error: %v", err)
+		pendingMu.Lock()
+		q, waiting := pending[key]
+		if !waiting && dst != nil {
+			if pc := nm.Get(key); pc != nil {
+				pendingMu.Unlock()
+				if _, err := pc.WriteTo(payload, dst); err != nil {
+					logf("UDP remote write error: %v", err)
+				}
 				continue
 			}
-
-			nm.Add(raddr, c, pc, remoteServer)
 		}
-
-		_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
-		if err != nil {
-			logf("UDP remote write error: %v", err)
+		if len(q) >= maxPendingPackets {
+			pendingMu.Unlock()
+			logf("UDP remote queue of %s full, dropping packet to %s", raddr, target)
 			continue
 		}
+		pending[key] = append(q, pendingPacket{target, append([]byte(nil), payload...)})
+		pendingMu.Unlock()
+		if !waiting {
+			go drain(raddr, key, ob)
+		}
+	}
+}
+
+// natConn wraps the upstream socket of a NAT session for accounting and rate limiting.
+func natConn(pc net.PacketConn, sess *session, laddr string) net.PacketConn {
+	if rl := config.RateLimit; rl != nil {
+		pc = &limitedPacketConn{pc, rl.Flow(limitKey(sess.User, laddr))}
 	}
+	return &countedPacketConn{pc, sess}
 }
 
+// errNATClosed ends a NAT session torn down before timing out, e.g. along with
+// its SOCKS UDP association.
+var errNATClosed = errors.New("NAT session closed")
+
 // Packet NAT table
 type natmap struct {
 	sync.RWMutex
@@ -212,14 +387,26 @@ func (m *natmap) Del(key string) net.PacketConn {
 	return nil
 }
 
-func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode) {
-	m.Set(peer.String(), src)
+func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode, sess *session) {
+	m.AddKey(peer.String(), peer, dst, src, role, sess)
+}
+
+// AddKey is like Add for a session stored under key rather than peer, for
+// peers with several sessions.
+func (m *natmap) AddKey(key string, peer net.Addr, dst, src net.PacketConn, role mode, sess *session) {
+	m.Set(key, src)
 
 	go func() {
-		timedCopy(dst, peer, src, m.timeout, role)
-		if pc := m.Del(peer.String()); pc != nil {
+		err := timedCopy(dst, peer, src, m.timeout, role)
+		if pc := m.Del(key); pc != nil {
 			pc.Close()
+		} else {
+			err = errNATClosed // src was removed and closed by someone else
+		}
+		if role == tproxyClient { // dst is private to the session
+			dst.Close()
 		}
+		sess.Log(closeReason(err))
 	}()
 }
 
@@ -245,6 +432,8 @@ func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout
 			_, err = dst.WriteTo(buf[len(srcAddr):n], target)
 		case socksClient: // client -> socks5 program: just set RSV and FRAG = 0
 			_, err = dst.WriteTo(append([]byte{0, 0, 0}, buf[:n]...), target)
+		case tproxyClient: // client -> transparent program: dst replies from the original packet source
+			_, err = dst.WriteTo(buf[:n], target)
 		}
 
 		if err != nil {